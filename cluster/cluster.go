@@ -0,0 +1,296 @@
+// Copyright 2019 Apcera Inc. All rights reserved.
+
+// Package cluster replicates channel message storage and durable
+// ack-position bookkeeping across a group of stan servers using
+// github.com/hashicorp/raft, so that sequence assignment for a channel
+// survives a node failing over to another.
+//
+// The intended flow, replacing a single node's assignAndStore:
+//
+//	propose a Command to the channel's Raft leader (Cluster.Propose)
+//	wait for the log entry to commit
+//	the FSM's Apply, run on every node once the entry commits, performs the
+//	actual Store.Store call (OpStore) or records a durable's new lastSent
+//	position (OpSetLastSent)
+//
+// Leader election decides which node owns sequence assignment for a given
+// channel: there is one Raft group per channel (see Config), so a busy
+// channel's leader need not be the same node as a quiet channel's. Only the
+// leader should run redelivery timers and heartbeats for that channel. On
+// failover the new leader's FSM has every OpSetLastSent position
+// replicated (see FSM.LastSent), but the server never reads those positions
+// back and acksPending itself is not replicated, so a durable's or queue
+// group's unacknowledged messages are not handed over to the new leader.
+//
+// What this package does not do: forward a publish received by a follower
+// to the current leader. Cluster.Propose simply fails with
+// raft.ErrNotLeader when called on a follower; routing that request on to
+// the leader needs a server-to-server RPC path that doesn't exist yet, and
+// is left as a follow-up.
+package cluster
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/nats-io/stan/pb"
+)
+
+// applyTimeout bounds how long Propose waits for a command to commit.
+const applyTimeout = 5 * time.Second
+
+// Op identifies what a Command does when applied to the FSM.
+type Op byte
+
+const (
+	// OpStore appends a message to a channel's message store, assigning it
+	// the next sequence number for that channel (mirrors Store.Store).
+	OpStore Op = iota
+	// OpSetLastSent records the last sequence delivered to a durable, so a
+	// newly-elected leader's FSM has the same redelivery starting point as
+	// the one it replaced.
+	OpSetLastSent
+)
+
+// Command is the unit of replication: one Raft log entry, gob-encoded as
+// the []byte passed to raft.Raft.Apply.
+type Command struct {
+	Op Op
+
+	// Subject, Reply and Data are used by OpStore; they mirror the
+	// arguments to Store.Store.
+	Subject string
+	Reply   string
+	Data    []byte
+
+	// DurableKey and LastSent are used by OpSetLastSent.
+	DurableKey string
+	LastSent   uint64
+}
+
+// Store is the subset of stan's Store interface that FSM.Apply needs to
+// replay an OpStore command; satisfied by stan's msgStore/fileMsgStore
+// without either package importing the other.
+type Store interface {
+	Store(subject, reply string, data []byte) (*pb.MsgProto, error)
+}
+
+// FSM applies committed Commands to a channel's Store and to a replicated
+// table of durable last-sent positions. One FSM (and one Cluster) exists
+// per replicated channel.
+type FSM struct {
+	store Store
+
+	mu       sync.Mutex
+	lastSent map[string]uint64 // durable key -> last delivered sequence
+}
+
+// NewFSM returns an FSM that applies OpStore commands to store.
+func NewFSM(store Store) *FSM {
+	return &FSM{store: store, lastSent: make(map[string]uint64)}
+}
+
+// LastSent returns the replicated last-delivered sequence for durableKey,
+// or 0 if none has been recorded.
+func (f *FSM) LastSent(durableKey string) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastSent[durableKey]
+}
+
+// Apply implements raft.FSM. It runs on every node (leader and followers)
+// once a Command's log entry commits.
+func (f *FSM) Apply(l *raft.Log) interface{} {
+	var cmd Command
+	if err := gob.NewDecoder(bytes.NewReader(l.Data)).Decode(&cmd); err != nil {
+		return err
+	}
+	switch cmd.Op {
+	case OpStore:
+		m, err := f.store.Store(cmd.Subject, cmd.Reply, cmd.Data)
+		if err != nil {
+			return err
+		}
+		return m
+	case OpSetLastSent:
+		f.mu.Lock()
+		f.lastSent[cmd.DurableKey] = cmd.LastSent
+		f.mu.Unlock()
+		return nil
+	default:
+		return fmt.Errorf("cluster: unknown command op %d", cmd.Op)
+	}
+}
+
+// fsmSnapshot snapshots only the lastSent table: message data itself is
+// recovered the same way a single node recovers a fileMsgStore today (by
+// replaying its segment file), so it is intentionally left out of the Raft
+// snapshot.
+type fsmSnapshot struct {
+	lastSent map[string]uint64
+}
+
+// Snapshot implements raft.FSM.
+func (f *FSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cp := make(map[string]uint64, len(f.lastSent))
+	for k, v := range f.lastSent {
+		cp[k] = v
+	}
+	return &fsmSnapshot{lastSent: cp}, nil
+}
+
+// Persist implements raft.FSMSnapshot.
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := gob.NewEncoder(sink).Encode(s.lastSent); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// Release implements raft.FSMSnapshot.
+func (s *fsmSnapshot) Release() {}
+
+// Restore implements raft.FSM.
+func (f *FSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	m := make(map[string]uint64)
+	if err := gob.NewDecoder(rc).Decode(&m); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.lastSent = m
+	f.mu.Unlock()
+	return nil
+}
+
+// Config bundles what New needs to start the Raft group for one channel.
+type Config struct {
+	// LocalID/Addr identify this node to Raft; Addr must be reachable by
+	// every peer.
+	LocalID string
+	Addr    string
+	// Peers lists every other node's Addr.
+	Peers []string
+	// Bootstrap starts a brand-new single-node-or-more cluster from Peers;
+	// set only on a node's first run for this channel, not on rejoin.
+	Bootstrap bool
+	// DataDir holds this channel's Raft snapshots (and, were a durable
+	// LogStore added, its log). One directory per channel; see New.
+	DataDir string
+}
+
+// Cluster wraps a single Raft group - one per replicated channel - plus the
+// Propose helper that implements "propose entry to the leader, wait for
+// commit, then apply".
+type Cluster struct {
+	raft *raft.Raft
+	fsm  *FSM
+}
+
+// New starts (or rejoins) the Raft group for one channel, replicating onto
+// fsm.
+//
+// The log/stable store is raft.NewInmemStore: this tree doesn't vendor a
+// disk-backed LogStore (e.g. raft-boltdb), so a node that restarts loses
+// its local Raft log and must catch up from the current leader's replicated
+// state instead of its own disk. That's acceptable for the leader-election
+// and failover behavior this is meant to provide, but a durable LogStore
+// should replace it before this is used for real crash recovery.
+func New(cfg Config, fsm *FSM) (*Cluster, error) {
+	raftCfg := raft.DefaultConfig()
+	raftCfg.LocalID = raft.ServerID(cfg.LocalID)
+
+	addr, err := net.ResolveTCPAddr("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(cfg.Addr, addr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(cfg.DataDir, 2, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	logStore := raft.NewInmemStore()
+	stableStore := raft.NewInmemStore()
+
+	r, err := raft.NewRaft(raftCfg, fsm, logStore, stableStore, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Bootstrap {
+		servers := []raft.Server{{ID: raftCfg.LocalID, Address: transport.LocalAddr()}}
+		for _, p := range cfg.Peers {
+			servers = append(servers, raft.Server{ID: raft.ServerID(p), Address: raft.ServerAddress(p)})
+		}
+		r.BootstrapCluster(raft.Configuration{Servers: servers})
+	}
+
+	return &Cluster{raft: r, fsm: fsm}, nil
+}
+
+// Propose replicates cmd through Raft and waits for it to commit and apply,
+// returning FSM.Apply's return value (e.g. the stored *pb.MsgProto for
+// OpStore). Returns raft.ErrNotLeader if this node isn't the leader for
+// this channel; see the package doc comment for why that case isn't
+// forwarded automatically.
+func (c *Cluster) Propose(cmd Command) (interface{}, error) {
+	if c.raft.State() != raft.Leader {
+		return nil, raft.ErrNotLeader
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cmd); err != nil {
+		return nil, err
+	}
+	f := c.raft.Apply(buf.Bytes(), applyTimeout)
+	if err := f.Error(); err != nil {
+		return nil, err
+	}
+	if err, ok := f.Response().(error); ok && err != nil {
+		return nil, err
+	}
+	return f.Response(), nil
+}
+
+// IsLeader reports whether this node currently owns sequence assignment -
+// and therefore should run heartbeats/redelivery - for this channel.
+func (c *Cluster) IsLeader() bool {
+	return c.raft.State() == raft.Leader
+}
+
+// LeaderCh notifies true/false as this node gains or loses leadership for
+// this channel, for driving a redelivery-timer hand-off on failover. The
+// acksPending state those timers act on lives in stan's subState, not in
+// the FSM, so it is unaffected by which node is currently leader.
+func (c *Cluster) LeaderCh() <-chan bool {
+	return c.raft.LeaderCh()
+}
+
+// Shutdown stops this channel's Raft group.
+func (c *Cluster) Shutdown() error {
+	return c.raft.Shutdown().Error()
+}
+
+// ChannelDataDir returns the per-channel subdirectory of baseDir that a
+// Config for channel should set DataDir to.
+func ChannelDataDir(baseDir, channel string) string {
+	return filepath.Join(baseDir, channel)
+}
@@ -0,0 +1,169 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stan
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Encoder interface is used to Encode and Decode messages published and
+// received on an EncodedConn. Implementations are registered under a name
+// with RegisterEncoder and selected by that name in NewEncodedConn, mirroring
+// the nats.EncodedConn pattern so STAN users don't have to hand-write
+// marshal/unmarshal code around Publish and Subscribe callbacks.
+type Encoder interface {
+	Encode(subject string, v interface{}) ([]byte, error)
+	Decode(subject string, data []byte, vPtr interface{}) error
+}
+
+// Well-known encoder names. This package registers no Encoder under them:
+// NewEncodedConn fails for each of these names until an Encoder has been
+// registered under it with RegisterEncoder.
+const (
+	JSON_ENCODER     = "json"
+	GOB_ENCODER      = "gob"
+	PROTOBUF_ENCODER = "protobuf"
+)
+
+var encoders = make(map[string]Encoder)
+
+// RegisterEncoder registers an Encoder under name, for later lookup by
+// NewEncodedConn.
+func RegisterEncoder(name string, enc Encoder) {
+	encoders[name] = enc
+}
+
+// EncodedConn wraps a Conn and an Encoder so callers can Publish and
+// Subscribe with Go values instead of raw []byte, removing the boilerplate
+// marshal/unmarshal code every STAN user otherwise writes by hand.
+type EncodedConn struct {
+	Conn Conn
+	Enc  Encoder
+}
+
+// NewEncodedConn creates an EncodedConn using the encoder registered under
+// encType (e.g. JSON_ENCODER).
+func NewEncodedConn(c Conn, encType string) (*EncodedConn, error) {
+	if c == nil {
+		return nil, ErrBadConnection
+	}
+	enc := encoders[encType]
+	if enc == nil {
+		return nil, fmt.Errorf("stan: no encoder registered for %q", encType)
+	}
+	return &EncodedConn{Conn: c, Enc: enc}, nil
+}
+
+// Publish encodes v and publishes it on subject, waiting for an ACK.
+func (c *EncodedConn) Publish(subject string, v interface{}) error {
+	b, err := c.Enc.Encode(subject, v)
+	if err != nil {
+		return err
+	}
+	return c.Conn.Publish(subject, b)
+}
+
+// PublishAsync encodes v and publishes it on subject, processing the ACK or
+// error state asynchronously. It returns the GUID for the message being sent.
+func (c *EncodedConn) PublishAsync(subject string, v interface{}, ah AckHandler) (string, error) {
+	b, err := c.Enc.Encode(subject, v)
+	if err != nil {
+		return "", err
+	}
+	return c.Conn.PublishAsync(subject, b, ah)
+}
+
+// errType is the reflect.Type of the error interface, used to recognize a
+// cb(v, error) callback signature in Subscribe below.
+var errType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Subscribe mirrors Conn.Subscribe but decodes each message before handing
+// it to cb. cb's argument type is inspected via reflection: it may be
+// func(v T), func(subject string, v T), or func(subject, reply string, v T),
+// each optionally followed by a trailing error parameter that receives any
+// decode failure instead of it being swallowed.
+func (c *EncodedConn) Subscribe(subject string, cb interface{}, opts ...SubscriptionOption) (Subscription, error) {
+	wrapped, err := c.wrapHandler(subject, cb)
+	if err != nil {
+		return nil, err
+	}
+	return c.Conn.Subscribe(subject, wrapped, opts...)
+}
+
+// QueueSubscribe mirrors Conn.QueueSubscribe but decodes each message before
+// handing it to cb; see Subscribe for the accepted cb signatures.
+func (c *EncodedConn) QueueSubscribe(subject, qgroup string, cb interface{}, opts ...SubscriptionOption) (Subscription, error) {
+	wrapped, err := c.wrapHandler(subject, cb)
+	if err != nil {
+		return nil, err
+	}
+	return c.Conn.QueueSubscribe(subject, qgroup, wrapped, opts...)
+}
+
+// wrapHandler builds a MsgHandler that decodes each delivered message's Data
+// into the value type expected by cb, then invokes cb with that value (and
+// the subject/reply and/or a decode error, if cb asks for them).
+func (c *EncodedConn) wrapHandler(subject string, cb interface{}) (MsgHandler, error) {
+	cbv := reflect.ValueOf(cb)
+	cbt := cbv.Type()
+	if cbt.Kind() != reflect.Func {
+		return nil, errors.New("stan: Subscribe handler must be a func")
+	}
+
+	numIn := cbt.NumIn()
+	if numIn == 0 {
+		return nil, errors.New("stan: Subscribe handler must accept at least one argument")
+	}
+
+	wantsErr := cbt.In(numIn-1) == errType
+	argIdx := numIn - 1
+	if wantsErr {
+		argIdx--
+	}
+	if argIdx < 0 {
+		return nil, errors.New("stan: Subscribe handler must accept a value argument")
+	}
+	valueType := cbt.In(argIdx)
+
+	// Leading string arguments (subject[, reply]) are passed through from
+	// the delivered Msg; everything before the value argument must be one.
+	for i := 0; i < argIdx; i++ {
+		if cbt.In(i).Kind() != reflect.String {
+			return nil, fmt.Errorf("stan: Subscribe handler argument %d must be a string", i)
+		}
+	}
+
+	return func(msg *Msg) {
+		vPtr := reflect.New(valueType)
+		decErr := c.Enc.Decode(subject, msg.Data, vPtr.Interface())
+
+		args := make([]reflect.Value, numIn)
+		switch argIdx {
+		case 1:
+			args[0] = reflect.ValueOf(msg.Subject)
+		case 2:
+			args[0] = reflect.ValueOf(msg.Subject)
+			args[1] = reflect.ValueOf(msg.Reply)
+		}
+		args[argIdx] = vPtr.Elem()
+		if wantsErr {
+			if decErr != nil {
+				args[numIn-1] = reflect.ValueOf(&decErr).Elem()
+			} else {
+				args[numIn-1] = reflect.Zero(errType)
+			}
+		} else if decErr != nil {
+			// Nowhere to report the decode error; drop the message rather
+			// than invoke cb with a zero value that looks like real data.
+			return
+		}
+		cbv.Call(args)
+	}, nil
+}
+
+// Close closes the underlying Conn.
+func (c *EncodedConn) Close() error {
+	return c.Conn.Close()
+}
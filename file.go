@@ -0,0 +1,277 @@
+// Copyright 2019 Apcera Inc. All rights reserved.
+
+package stan
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nats-io/stan/pb"
+)
+
+// fileMsgStore is a Store implementation that appends every message to a
+// single per-channel segment file as a length-prefixed, gob-free protobuf
+// record, and keeps an in-memory index (sequence -> file offset) rebuilt by
+// scanning the file on open. This gives durables and message history
+// survival across a restart without requiring a separate index file: the
+// segment file is the source of truth and the index is always
+// reconstructible from it.
+//
+// Like msgStore, a fileMsgStore enforces DefaultMsgStoreLimit by dropping
+// the oldest message, except the drop only removes it from the in-memory
+// index: the segment file is append-only and is never compacted by this
+// implementation.
+type fileMsgStore struct {
+	sync.RWMutex
+	subject string
+	file    *os.File
+	offsets map[uint64]int64 // sequence -> offset of the record in file
+	order   []uint64         // sequences in store order, oldest first
+	first   uint64
+	last    uint64
+	limits  ChannelLimits
+	bytes   uint64
+}
+
+// recordHeaderLen is the length of the fixed-size header prefixed to every
+// stored record: a big-endian uint32 giving the length of the marshaled
+// pb.MsgProto that follows.
+const recordHeaderLen = 4
+
+// newFileMsgStore opens (creating if necessary) the segment file for
+// subject under dir, recovering its index by scanning any existing
+// records.
+func newFileMsgStore(dir, subject string) (*fileMsgStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("stan: FileStoreDir must be set to use FileStore")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, subject+".dat")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fms := &fileMsgStore{
+		subject: subject,
+		file:    f,
+		offsets: make(map[uint64]int64),
+		first:   1,
+	}
+	if err := fms.recover(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return fms, nil
+}
+
+// recover scans the segment file from the beginning, rebuilding the
+// sequence -> offset index and first/last sequence bookkeeping.
+func (fms *fileMsgStore) recover() error {
+	var header [recordHeaderLen]byte
+	var offset int64
+
+	for {
+		if _, err := io.ReadFull(fms.file, header[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		recLen := binary.BigEndian.Uint32(header[:])
+
+		buf := make([]byte, recLen)
+		if _, err := io.ReadFull(fms.file, buf); err != nil {
+			return err
+		}
+
+		m := &pb.MsgProto{}
+		if err := m.Unmarshal(buf); err != nil {
+			return err
+		}
+
+		fms.offsets[m.Sequence] = offset
+		fms.order = append(fms.order, m.Sequence)
+		if len(fms.order) == 1 {
+			fms.first = m.Sequence
+		}
+		fms.last = m.Sequence
+		fms.bytes += uint64(m.Size())
+
+		offset += recordHeaderLen + int64(recLen)
+	}
+	return nil
+}
+
+// readAt reads and unmarshals the record stored at offset.
+func (fms *fileMsgStore) readAt(offset int64) (*pb.MsgProto, error) {
+	var header [recordHeaderLen]byte
+	if _, err := fms.file.ReadAt(header[:], offset); err != nil {
+		return nil, err
+	}
+	recLen := binary.BigEndian.Uint32(header[:])
+
+	buf := make([]byte, recLen)
+	if _, err := fms.file.ReadAt(buf, offset+recordHeaderLen); err != nil {
+		return nil, err
+	}
+
+	m := &pb.MsgProto{}
+	if err := m.Unmarshal(buf); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Store appends a new message to the segment file and returns it.
+func (fms *fileMsgStore) Store(subject, reply string, data []byte) (*pb.MsgProto, error) {
+	fms.Lock()
+	defer fms.Unlock()
+
+	seq := fms.last + 1
+	m := &pb.MsgProto{
+		Sequence:  seq,
+		Subject:   subject,
+		Reply:     reply,
+		Data:      data,
+		Timestamp: time.Now().UnixNano(),
+	}
+
+	buf, err := m.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	offset, err := fms.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	var header [recordHeaderLen]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(buf)))
+	if _, err := fms.file.Write(header[:]); err != nil {
+		return nil, err
+	}
+	if _, err := fms.file.Write(buf); err != nil {
+		return nil, err
+	}
+
+	fms.offsets[seq] = offset
+	fms.order = append(fms.order, seq)
+	if len(fms.order) == 1 {
+		fms.first = seq
+	}
+	fms.last = seq
+	fms.bytes += uint64(m.Size())
+
+	maxMsgs := fms.limits.MaxMsgs
+	if maxMsgs == 0 {
+		maxMsgs = DefaultMsgStoreLimit
+	}
+	for len(fms.order) > 0 && (len(fms.order) > maxMsgs || (fms.limits.MaxBytes > 0 && fms.bytes > fms.limits.MaxBytes)) {
+		oldest := fms.order[0]
+		if oldestMsg, ok := fms.offsets[oldest]; ok {
+			if om, err := fms.readAt(oldestMsg); err == nil {
+				fms.bytes -= uint64(om.Size())
+			}
+		}
+		fms.order = fms.order[1:]
+		delete(fms.offsets, oldest)
+		if len(fms.order) > 0 {
+			fms.first = fms.order[0]
+		}
+	}
+
+	return m, nil
+}
+
+// Usage reports the current message count, byte usage and effective limits
+// for the channel.
+func (fms *fileMsgStore) Usage() (count int, bytes uint64, limits ChannelLimits) {
+	fms.RLock()
+	defer fms.RUnlock()
+	return len(fms.order), fms.bytes, fms.limits
+}
+
+// setLimits updates fms.limits; MaxAge is not enforced by fileMsgStore
+// (there is no background aging goroutine for the file-backed store), only
+// MaxMsgs/MaxBytes, applied on the next Store call.
+func (fms *fileMsgStore) setLimits(limits ChannelLimits) {
+	fms.Lock()
+	defer fms.Unlock()
+	fms.limits = limits
+}
+
+// Close closes the underlying segment file.
+func (fms *fileMsgStore) Close() error {
+	return fms.file.Close()
+}
+
+// FirstSequence returns the sequence of the first message stored.
+func (fms *fileMsgStore) FirstSequence() uint64 {
+	fms.RLock()
+	defer fms.RUnlock()
+	return fms.first
+}
+
+// LastSequence returns the sequence of the last message stored.
+func (fms *fileMsgStore) LastSequence() uint64 {
+	fms.RLock()
+	defer fms.RUnlock()
+	return fms.last
+}
+
+// Lookup returns the message stored under seq, or nil.
+func (fms *fileMsgStore) Lookup(seq uint64) *pb.MsgProto {
+	fms.RLock()
+	offset, ok := fms.offsets[seq]
+	fms.RUnlock()
+	if !ok {
+		return nil
+	}
+	m, err := fms.readAt(offset)
+	if err != nil {
+		Errorf("STAN: error reading message %d for [`%s`]: %v", seq, fms.subject, err)
+		return nil
+	}
+	return m
+}
+
+// FirstMsg returns the first message stored, or nil.
+func (fms *fileMsgStore) FirstMsg() *pb.MsgProto {
+	fms.RLock()
+	first := fms.first
+	fms.RUnlock()
+	return fms.Lookup(first)
+}
+
+// LastMsg returns the last message stored, or nil.
+func (fms *fileMsgStore) LastMsg() *pb.MsgProto {
+	fms.RLock()
+	last := fms.last
+	fms.RUnlock()
+	return fms.Lookup(last)
+}
+
+// Msgs returns up to count messages starting at fromSeq, in sequence order.
+func (fms *fileMsgStore) Msgs(fromSeq uint64, count int) []*pb.MsgProto {
+	fms.RLock()
+	last := fms.last
+	fms.RUnlock()
+
+	res := make([]*pb.MsgProto, 0, count)
+	for seq := fromSeq; seq <= last && len(res) < count; seq++ {
+		if m := fms.Lookup(seq); m != nil {
+			res = append(res, m)
+		}
+	}
+	return res
+}
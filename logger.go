@@ -0,0 +1,66 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stan
+
+// Logger is the interface a connection uses to report internal diagnostics
+// (ack-unmarshal failures, orphaned acks, timeout expirations, a missing
+// subscription in processMsg, ...) that previously went to a stray
+// fmt.Printf or a panic. Implementations can wrap zap, logrus, slog, or
+// anything else; NoopLogger is the default so existing behavior is
+// preserved apart from those diagnostics no longer crashing or printing
+// straight to stdout.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// NoopLogger discards everything. It is the default Logger so a connection
+// created without SetLogger behaves as before, minus the stray Printf/panic.
+type NoopLogger struct{}
+
+func (NoopLogger) Debugf(format string, v ...interface{}) {}
+func (NoopLogger) Infof(format string, v ...interface{})  {}
+func (NoopLogger) Errorf(format string, v ...interface{}) {}
+
+// SetLogger is an Option to have the connection route its internal
+// diagnostics through a caller-supplied Logger instead of discarding them.
+func SetLogger(l Logger) Option {
+	return func(o *Options) error {
+		o.Logger = l
+		return nil
+	}
+}
+
+// TraceHooks, if set via SetTraceHooks, are invoked at key points in a
+// message's lifecycle so an application can export metrics or distributed
+// traces without instrumenting every call site itself. Any hook left nil is
+// skipped. Hooks are called synchronously on the goroutine that triggered
+// them: OnPublish on the goroutine calling Publish; OnMsg, OnRedeliver and
+// the OnAck for a server ACK on the NATS subscription callback; the OnAck
+// for a timeout, a cancelled context or a lost connection on one of the
+// connection's own background goroutines. They must not block or call back
+// into the Conn.
+type TraceHooks struct {
+	// OnPublish is called right after a message is handed to the NATS
+	// connection for publishing, before the ACK is known.
+	OnPublish func(guid, subject string)
+	// OnAck is called when the server ACKs (err == nil) or fails to ACK
+	// (err != nil, e.g. ErrTimeout or ctx.Err()) a published message.
+	OnAck func(guid string, err error)
+	// OnRedeliver is called when a message arrives flagged Redelivered,
+	// i.e. the server resent it because it was not acked within AckWait.
+	OnRedeliver func(subject string, seq uint64)
+	// OnMsg is called for every message delivered to a subscription's
+	// callback, redelivered or not.
+	OnMsg func(subject string, seq uint64)
+}
+
+// SetTraceHooks is an Option to register lifecycle hooks for publish, ack,
+// redeliver and message-delivery events; see TraceHooks.
+func SetTraceHooks(h TraceHooks) Option {
+	return func(o *Options) error {
+		o.TraceHooks = h
+		return nil
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 Apcera Inc. All rights reserved.
+
+package stan
+
+import (
+	"errors"
+	"net/http"
+
+	monitorpkg "github.com/nats-io/nats-streaming-server/server"
+)
+
+// monitorSource adapts a running stanServer to server.MonitorDataSource, so
+// RunServerWithOpts can back a real server.Monitor with this server's own
+// state instead of leaving it orphaned with nothing to query - see
+// startMonitor and ServerOptions.MonitorAddr.
+type monitorSource struct {
+	s *stanServer
+}
+
+// ChannelNames implements server.MonitorDataSource from this server's own
+// channelMap.
+func (m monitorSource) ChannelNames() []string {
+	m.s.channels.RLock()
+	defer m.s.channels.RUnlock()
+	names := make([]string, 0, len(m.s.channels.channels))
+	for name := range m.s.channels.channels {
+		names = append(names, name)
+	}
+	return names
+}
+
+// ClientIDs implements server.MonitorDataSource. It always returns an empty
+// list: clientStore, unlike channelMap, has no method anywhere in this tree
+// to enumerate the clients it holds (only Lookup/Register/Unregister are
+// ever called on it) - a gap in clientStore itself, independent of and
+// deeper than the stores-package carve-out server/monitor.go documents.
+// ChannelPath is genuinely backed by live data; ClientsPath is reachable
+// and correctly shaped but always empty until clientStore grows a way to
+// list what it holds.
+func (m monitorSource) ClientIDs() []string {
+	return nil
+}
+
+// startMonitor constructs a server.Monitor backed by this server, registers
+// a nats_connected health check against this server's own NATS connection
+// so HealthzPath/ReadyzPath reflect real state instead of always reporting
+// healthy, and starts it listening on sOpts.MonitorAddr in the background,
+// if set. Like ClusterAddr, leaving MonitorAddr empty keeps monitoring
+// entirely opt-in.
+func (s *stanServer) startMonitor() {
+	if s.opts.MonitorAddr == "" {
+		return
+	}
+	s.monitor = monitorpkg.NewMonitor(string(s.opts.StoreType), monitorSource{s: s})
+	// Not server.NatsConnectedCheck: it takes a *nats.Conn from
+	// github.com/nats-io/go-nats, a different module than the
+	// github.com/nats-io/nats connection this server actually holds in
+	// s.nc, so the types don't line up. IsConnected exists on both, so
+	// check it directly instead.
+	s.monitor.Health.AddCheck(monitorpkg.Check{
+		Name: "nats_connected",
+		Run: func() error {
+			if s.nc == nil || !s.nc.IsConnected() {
+				return errors.New("stan: not connected to NATS")
+			}
+			return nil
+		},
+	})
+	s.monitorHTTP = &http.Server{Addr: s.opts.MonitorAddr, Handler: s.monitor.Mux()}
+	go func() {
+		if err := s.monitorHTTP.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			Errorf("STAN: monitor HTTP server error: %v", err)
+		}
+	}()
+}
+
+// stopMonitor shuts down the monitor HTTP server started by startMonitor,
+// if one is running. Called from Shutdown.
+func (s *stanServer) stopMonitor() {
+	if s.monitorHTTP != nil {
+		s.monitorHTTP.Close()
+		s.monitorHTTP = nil
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2019 Apcera Inc. All rights reserved.
+
+package stan_test
+
+import (
+	"testing"
+	"time"
+
+	stan "github.com/nats-io/nats-streaming-server"
+	"github.com/nats-io/nats-streaming-server/stantest"
+)
+
+// TestExclusiveQueueFailover covers stan.ExclusiveQueue: with two members in
+// an exclusive group, only the oldest surviving member should ever receive a
+// message, and the other member should take over once that member
+// unsubscribes - first receiving the message the old member left unacked,
+// then new messages - while the member that left receives nothing more.
+func TestExclusiveQueueFailover(t *testing.T) {
+	srv, shutdown, err := stantest.NewServer("test-cluster", "exclusive-client")
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer shutdown()
+
+	const subject = "orders"
+	recvA := make(chan *stan.Msg, 10)
+	recvB := make(chan *stan.Msg, 10)
+
+	subA, err := srv.Conn().QueueSubscribe(subject, "grp", func(m *stan.Msg) { recvA <- m },
+		stan.SetManualAckMode(), stan.ExclusiveQueue())
+	if err != nil {
+		t.Fatalf("QueueSubscribe A: %v", err)
+	}
+	if _, err := srv.Conn().QueueSubscribe(subject, "grp", func(m *stan.Msg) { recvB <- m },
+		stan.SetManualAckMode(), stan.ExclusiveQueue()); err != nil {
+		t.Fatalf("QueueSubscribe B: %v", err)
+	}
+
+	if _, err := srv.Publish(subject, []byte("first")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	select {
+	case m := <-recvA:
+		if string(m.Data) != "first" {
+			t.Fatalf("A got unexpected data %q", m.Data)
+		}
+	case <-recvB:
+		t.Fatal("non-active member B received a message before the active member A unsubscribed")
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the active member to receive the first message")
+	}
+
+	// A was the active member; removing it should promote B without B
+	// having received anything up to this point.
+	select {
+	case <-recvB:
+		t.Fatal("B received a message while A was still the active member")
+	default:
+	}
+	if err := subA.Unsubscribe(); err != nil {
+		t.Fatalf("Unsubscribe A: %v", err)
+	}
+
+	if _, err := srv.Publish(subject, []byte("second")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	// B is handed A's unacked "first" when A unsubscribes, then gets the
+	// newly published "second".
+	for _, want := range []string{"first", "second"} {
+		select {
+		case m := <-recvB:
+			if string(m.Data) != want {
+				t.Fatalf("B got unexpected data %q, want %q", m.Data, want)
+			}
+		case <-recvA:
+			t.Fatal("A received a message after being unsubscribed")
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for B to take over as the active member")
+		}
+	}
+}
+
+// TestBindQueueGroupAfterDrain covers the concern BindQueueGroup (and its
+// server-side CheckAndMarkPendingBind/Store atomicity) exists for: once a
+// queue group's last member has unsubscribed, the group name must go back
+// to "doesn't exist" - a later BindQueueGroup call under the same name must
+// fail with ErrInvalidSub rather than silently starting a brand new,
+// single-member group under a name the caller expects to already be
+// populated.
+func TestBindQueueGroupAfterDrain(t *testing.T) {
+	srv, shutdown, err := stantest.NewServer("test-cluster", "drain-client")
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer shutdown()
+
+	const subject = "orders"
+
+	sub, err := srv.Conn().QueueSubscribe(subject, "grp", func(m *stan.Msg) {},
+		stan.SetManualAckMode())
+	if err != nil {
+		t.Fatalf("QueueSubscribe: %v", err)
+	}
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Unsubscribe: %v", err)
+	}
+
+	if _, err := srv.Conn().BindQueueGroup(subject, "grp", func(m *stan.Msg) {}); err == nil {
+		t.Fatal("BindQueueGroup succeeded on a group whose last member had already unsubscribed")
+	}
+}
+
+// TestPullModeFetch covers the pull-mode conversion and Fetch path (see
+// stan.PullModeRequest/stan.FetchRequest): a queue member converted to pull
+// mode should stop receiving asynchronous pushes and only get messages it
+// explicitly Fetches.
+func TestPullModeFetch(t *testing.T) {
+	srv, shutdown, err := stantest.NewServer("test-cluster", "pull-client")
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer shutdown()
+
+	const subject = "orders"
+	const clientID = "pull-client"
+	pushed := make(chan *stan.Msg, 10)
+
+	if _, err := srv.Conn().QueueSubscribe(subject, "grp", func(m *stan.Msg) { pushed <- m },
+		stan.SetManualAckMode()); err != nil {
+		t.Fatalf("QueueSubscribe: %v", err)
+	}
+
+	var ackInbox string
+	for _, info := range srv.Subscriptions(clientID) {
+		if info.Subject == subject {
+			ackInbox = info.AckInbox
+		}
+	}
+	if ackInbox == "" {
+		t.Fatal("could not find subscription's ack inbox")
+	}
+
+	if err := srv.PullMode(subject, ackInbox); err != nil {
+		t.Fatalf("PullMode: %v", err)
+	}
+
+	if _, err := srv.Publish(subject, []byte("pulled")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	select {
+	case m := <-pushed:
+		t.Fatalf("message %q was pushed to a pull-mode member", m.Data)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	msgs, err := srv.Fetch(subject, ackInbox, 1, time.Second, false)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 fetched message, got %d", len(msgs))
+	}
+	if string(msgs[0].Data) != "pulled" {
+		t.Fatalf("fetched unexpected data %q", msgs[0].Data)
+	}
+}
+
+// TestRedeliveryBackoff covers RedeliveryPolicy's exponential backoff: an
+// unacked message's successive redeliveries should be spaced further apart
+// each time, not redelivered at a flat interval.
+func TestRedeliveryBackoff(t *testing.T) {
+	srv, shutdown, err := stantest.NewServer("test-cluster", "backoff-client")
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer shutdown()
+
+	const subject = "orders"
+	srv.SetRedeliveryPolicy(subject, stan.RedeliveryPolicy{
+		InitialWait: 150 * time.Millisecond,
+		Multiplier:  3,
+	})
+
+	deliveries := make(chan time.Time, 5)
+	// AckWait is sent in whole seconds and the server rejects anything
+	// below one, so use the minimum; with a RedeliveryPolicy set it is only
+	// the fallback. The actual redelivery spacing is driven by
+	// RedeliveryPolicy.backOffFor, not this value (see sendMsgToSub's
+	// ackTimer and performRedelivery's remaining/ackTimer.Reset logic in
+	// server.go).
+	if _, err := srv.Conn().QueueSubscribe(subject, "grp", func(m *stan.Msg) {
+		deliveries <- time.Now()
+	}, stan.SetManualAckMode(), stan.AckWait(time.Second)); err != nil {
+		t.Fatalf("QueueSubscribe: %v", err)
+	}
+
+	if _, err := srv.Publish(subject, []byte("unacked")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	var times []time.Time
+	for i := 0; i < 3; i++ {
+		select {
+		case ts := <-deliveries:
+			times = append(times, ts)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for delivery %d", i+1)
+		}
+	}
+
+	firstGap := times[1].Sub(times[0])
+	secondGap := times[2].Sub(times[1])
+	if secondGap <= firstGap {
+		t.Fatalf("expected growing redelivery backoff, got gaps %v then %v", firstGap, secondGap)
+	}
+}
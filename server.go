@@ -3,8 +3,12 @@
 package stan
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
 	"os"
 	"sort"
 	"strings"
@@ -14,6 +18,8 @@ import (
 	"github.com/nats-io/gnatsd/logger"
 	"github.com/nats-io/gnatsd/server"
 	"github.com/nats-io/nats"
+	"github.com/nats-io/nats-streaming-server/cluster"
+	monitorpkg "github.com/nats-io/nats-streaming-server/server"
 	"github.com/nats-io/nuid"
 	"github.com/nats-io/stan/pb"
 
@@ -23,10 +29,33 @@ import (
 // A single STAN server
 
 const (
-	DefaultPubPrefix   = "_STAN.pub"
-	DefaultSubPrefix   = "_STAN.sub"
-	DefaultUnSubPrefix = "_STAN.unsub"
-	DefaultClosePrefix = "_STAN.close"
+	DefaultPubPrefix       = "_STAN.pub"
+	DefaultSubPrefix       = "_STAN.sub"
+	DefaultUnSubPrefix     = "_STAN.unsub"
+	DefaultSubClosePrefix  = "_STAN.subclose"
+	DefaultClosePrefix     = "_STAN.close"
+	DefaultPingPrefix      = "_STAN.ping"
+	DefaultSubStatusPrefix = "_STAN.substatus"
+	// DefaultPullConvertPrefix is the prefix stanServer.pullConvertRequests
+	// is derived from; see processPullModeRequest.
+	DefaultPullConvertPrefix = "_STAN.pullconvert"
+	// DefaultFetchPrefix is the prefix stanServer.fetchRequests is derived
+	// from; see processFetchRequest.
+	DefaultFetchPrefix = "_STAN.fetch"
+	// DefaultExclusiveQueuePrefix is the prefix stanServer.exclusiveQueueRequests
+	// is derived from. Unlike DefaultPullConvertPrefix/DefaultFetchPrefix,
+	// this subject is NOT suffixed with a per-server nuid: a client calling
+	// stan.ExclusiveQueue() needs to reach it with nothing more than the
+	// clusterID it already passed to Connect (see conn.clusterID), and
+	// pb.ConnectResponse has no spare field to hand back a random one the
+	// way SubRequests/UnsubRequests/... are discovered. So this is derived
+	// the same deterministic way discoverSubject already is: prefix plus
+	// clusterID, computable independently by both sides.
+	DefaultExclusiveQueuePrefix = "_STAN.exclusivequeue"
+	// DefaultQueueGroupPrefix is the prefix stanServer.queueGroupRequests is
+	// derived from, the same deterministic (non-nuid) way
+	// DefaultExclusiveQueuePrefix is; see stan.BindQueueGroup.
+	DefaultQueueGroupPrefix = "_STAN.queuegroup"
 
 	// How many messages per channel will we store?
 	DefaultMsgStoreLimit = 1000000
@@ -41,48 +70,141 @@ const (
 
 // Errors.
 var (
-	ErrBadPubMsg       = errors.New("stan: malformed publish message envelope")
-	ErrBadSubRequest   = errors.New("stan: malformed subscription request")
-	ErrInvalidSubject  = errors.New("stan: invalid subject")
-	ErrInvalidSequence = errors.New("stan: invalid start sequence")
-	ErrInvalidTime     = errors.New("stan: invalid start time")
-	ErrInvalidSub      = errors.New("stan: invalid subscription")
-	ErrInvalidConnReq  = errors.New("stan: invalid connection request")
-	ErrInvalidClient   = errors.New("stan: clientID already registered")
-	ErrInvalidCloseReq = errors.New("stan: invalid close request")
-	ErrInvalidAckWait  = errors.New("stan: invalid ack wait time, should be >= 1s")
-	ErrDupDurable      = errors.New("stan: duplicate durable registration")
-	ErrDurableQueue    = errors.New("stan: queue subscribers can't be durable")
+	ErrBadPubMsg                  = errors.New("stan: malformed publish message envelope")
+	ErrBadSubRequest              = errors.New("stan: malformed subscription request")
+	ErrInvalidSubject             = errors.New("stan: invalid subject")
+	ErrInvalidSequence            = errors.New("stan: invalid start sequence")
+	ErrInvalidTime                = errors.New("stan: invalid start time")
+	ErrInvalidSub                 = errors.New("stan: invalid subscription")
+	ErrInvalidConnReq             = errors.New("stan: invalid connection request")
+	ErrInvalidClient              = errors.New("stan: clientID already registered")
+	ErrInvalidCloseReq            = errors.New("stan: invalid close request")
+	ErrInvalidAckWait             = errors.New("stan: invalid ack wait time, should be >= 1s")
+	ErrDupDurable                 = errors.New("stan: duplicate durable registration")
+	ErrDurableQueue               = errors.New("stan: queue subscribers can't be durable")
+	ErrMultiSubjectDurableOrQueue = errors.New("stan: multi-subject filters cannot be durable or a queue subscriber")
+	ErrInvalidMaxDeliver          = errors.New("stan: invalid max deliver, should be >= 0")
+	ErrDeliverGroupMismatch       = errors.New("stan: durable name already in use as a queue group name on this channel")
+	ErrPublishNotReplicated       = errors.New("stan: publish was not stored, server is not the channel leader")
 )
 
 type stanServer struct {
-	clusterID     string
-	serverID      string
-	pubPrefix     string // Subject prefix we received published messages on.
-	subRequests   string // Subject we receive subscription requests on.
-	unsubRequests string // Subject we receive unsubscribe requests on.
-	closeRequests string // Subject we receive close requests on.
-	natsServer    *server.Server
-	opts          *ServerOptions
-	nc            *nats.Conn
+	clusterID              string
+	serverID               string
+	pubPrefix              string // Subject prefix we received published messages on.
+	subRequests            string // Subject we receive subscription requests on.
+	unsubRequests          string // Subject we receive unsubscribe requests on.
+	subCloseRequests       string // Subject we receive subscription close (suspend) requests on.
+	closeRequests          string // Subject we receive close requests on.
+	pingRequests           string // Subject we receive client-to-server pings on.
+	subStatusRequests      string // Subject we receive subscription status (Pending/Dropped) requests on.
+	pullConvertRequests    string // Subject we receive PullModeRequest conversions on.
+	fetchRequests          string // Subject we receive FetchRequests on.
+	exclusiveQueueRequests string // Subject we receive ExclusiveQueueRequests on.
+	queueGroupRequests     string // Subject we receive QueueGroupRequests on.
+	natsServer             *server.Server
+	opts                   *ServerOptions
+	nc                     *nats.Conn
+	// clock is consulted wherever this server needs the current wall time
+	// (e.g. resolving StartPosition_TimeDeltaStart); defaults to
+	// realClock{} in RunServerWithOpts and can be overridden with SetClock
+	// so a test harness (see the stantest subpackage) gets deterministic
+	// behavior instead of depending on real timing.
+	clock Clock
 
 	// Clients
 	clients *clientStore
 
 	// Channels
 	channels *channelMap
+
+	// monitor and monitorHTTP are non-nil only when ServerOptions.MonitorAddr
+	// is set; see startMonitor in monitor.go.
+	monitor     *monitorpkg.Monitor
+	monitorHTTP *http.Server
+}
+
+// ServerHandle is the external name for the *stanServer value returned by
+// RunServer/RunServerWithOpts. stanServer itself stays unexported - every
+// other package in this tree reaches it only through that constructor and
+// its exported methods (SetFlowControl, SetClock, Shutdown, ...) - but a
+// type alias lets a package like stantest, which needs to embed or name the
+// type, do so without depending on an exported struct name.
+type ServerHandle = stanServer
+
+// Clock abstracts wall-clock reads for the handful of places this server
+// resolves a duration relative to "now" (currently just
+// StartPosition_TimeDeltaStart resolution in processSubscriptionRequest).
+// RunServerWithOpts defaults every server to realClock{}; see SetClock and
+// FixedClock.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the default Clock, backed by the actual wall clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// FixedClock is a Clock that always reports the same instant t, for
+// deterministic tests of TimeDeltaStart resolution without waiting on real
+// time; see the stantest subpackage's Server.SetTime.
+type FixedClock time.Time
+
+// Now implements Clock.
+func (c FixedClock) Now() time.Time { return time.Time(c) }
+
+// SetClock overrides s's Clock; see Clock and FixedClock. Intended for a
+// test harness - production use has no reason to call this, since
+// RunServerWithOpts already defaults to the real wall clock.
+func (s *stanServer) SetClock(c Clock) {
+	s.clock = c
 }
 
 // Map from subject to channelStore
 type channelMap struct {
 	sync.RWMutex
-	channels map[string]*channelStore
+	channels      map[string]*channelStore
+	opts          *ServerOptions
+	subjectLimits map[string]ChannelLimits // per-subject overrides, set via stanServer.SetChannelLimits
+	// subjectRedelivery holds per-subject overrides set via
+	// stanServer.SetRedeliveryPolicy; see redeliveryPolicyFor.
+	subjectRedelivery map[string]RedeliveryPolicy
+	// subjectDispatch holds per-subject overrides set via
+	// stanServer.SetQueueDispatchPolicy; see dispatchPolicyFor.
+	subjectDispatch map[string]QueueDispatchPolicy
+	// subjectFlowControl holds per-subject overrides set via
+	// stanServer.SetFlowControl; see flowControlFor.
+	subjectFlowControl map[string]FlowControl
+	// subjectPendingLimits holds per-subject overrides set via
+	// stanServer.SetPendingLimits; see pendingLimitsFor.
+	subjectPendingLimits map[string]PendingLimits
+	// wildcardSubs holds every subscription that has at least one filter
+	// subject containing "*" or ">", so that LookupOrCreate can register
+	// it against channels created after the subscription was made. See
+	// subState.filters.
+	//
+	// This, plus the matching walk over cm.channels in
+	// processSubscriptionRequest and filterMatchesSubject, is this tree's
+	// answer to a subject-token trie: a plain slice scanned with
+	// filterMatchesSubject rather than a trie keyed by token, on the same
+	// reasoning as acksPending's bounded linear scan elsewhere in this
+	// file - the number of wildcard subscriptions on a server is small
+	// relative to its channel count, so the O(subs) match cost on each new
+	// channel doesn't justify a token-trie's extra bookkeeping.
+	wildcardSubs []*subState
 }
 
 // channelStore holds our known state of all messages and subscribers for a given channel/subject.
 type channelStore struct {
-	subs *subStore // All subscribers
-	msgs *msgStore // All messages
+	subject string    // Literal subject this channelStore was created for.
+	subs    *subStore // All subscribers
+	msgs    Store     // All messages
+	// cluster replicates msgs and durable lastSent positions across
+	// ServerOptions.ClusterPeers via Raft; nil unless clustering is
+	// enabled, in which case every channel runs its own Raft group. See
+	// channelMap.startCluster, assignAndStore and performRedelivery.
+	cluster *cluster.Cluster
 }
 
 // subStore holds all known state for all subscriptions
@@ -92,6 +214,17 @@ type subStore struct {
 	qsubs    map[string]*queueState // queue subscribers
 	durables map[string]*subState   // durables lookup
 	acks     map[string]*subState   // ack inbox lookup
+
+	// pendingQueueBinds marks clientIDs that just passed the queue group
+	// existence check in processQueueGroupRequest and are expected to
+	// immediately follow up with the real subscribe; see CheckAndMarkPendingBind
+	// and Store. This is what makes stan.BindQueueGroup's "the group must
+	// already exist" guarantee atomic: the existence check and the join
+	// are two separate server requests (the JSON QueueGroupRequest and the
+	// pb SubscriptionRequest), but Store re-checks qsubs for this qgroup
+	// itself, under the same lock that would create it, instead of
+	// trusting the earlier check's now-possibly-stale answer.
+	pendingQueueBinds map[string]struct{}
 }
 
 // Holds all queue subsribers for a subject/group and
@@ -101,26 +234,206 @@ type queueState struct {
 	lastSent uint64
 	subs     []*subState
 	stalled  bool
+	// dispatchPolicy selects which member receives the next message; see
+	// findBestQueueSub. Captured from channelMap.dispatchPolicyFor when the
+	// group's first member subscribes and left unset (defaulting to
+	// DispatchLeastOutstanding) after that.
+	dispatchPolicy QueueDispatchPolicy
+	// rrCursor is the next index to try under DispatchRoundRobin.
+	rrCursor int
+	// waiters are wake-up channels registered by a blocking FetchRequest
+	// (see addWaiter/notifyWaiters); notified whenever a new message is
+	// stored for this group, so a pull-mode Fetch waiting on MaxWait
+	// doesn't have to sit out its full timeout once one arrives.
+	waiters []chan struct{}
+	// exclusive marks the group single-active, set by an
+	// ExclusiveQueueRequest (see stan.ExclusiveQueue): only one member - the
+	// surviving one with the lowest joinSeq - is ever push-eligible; see
+	// pushMembers.
+	exclusive bool
+	// nextJoin hands out each new member's subState.joinSeq; see
+	// subStore.Store.
+	nextJoin uint64
 }
 
 // Holds Subscription state
 // FIXME(dlc) - Use embedded proto
 type subState struct {
 	sync.RWMutex
-	clientID      string
-	subject       string
-	qgroup        string
-	inbox         string
-	ackInbox      string
-	durableName   string
-	qstate        *queueState
-	lastSent      uint64
-	ackWaitInSecs time.Duration
-	ackTimer      *time.Timer
-	ackSub        *nats.Subscription
-	acksPending   map[uint64]*pb.MsgProto
-	maxInFlight   int
-	stalled       bool
+	clientID string
+	subject  string // Primary/display subject; filters[0] when len(filters) > 1.
+	// filters holds every subject this subscription was registered for.
+	// len(filters) == 1 (and filters[0] == subject) for an ordinary,
+	// single-subject subscription; a multi-subject subscription (see
+	// parseFilterSubjects) has one entry per requested subject, each of
+	// which may itself be a literal subject or a "*"/">" wildcard.
+	filters     []string
+	qgroup      string
+	inbox       string
+	ackInbox    string
+	durableName string
+	qstate      *queueState
+	lastSent    uint64
+	// lastSentByChannel tracks, per registered channel, the last sequence
+	// delivered on that channel. Only consulted when len(filters) > 1;
+	// ordinary subscriptions use lastSent directly. See lastSentFor.
+	lastSentByChannel map[string]uint64
+	lastAcked         uint64
+	ackWaitInSecs     time.Duration
+	ackTimer          *time.Timer
+	// rateTimer is armed by sendMsgToSub when delivery is stalled purely
+	// because flowControl.RateLimitBps' token bucket is empty (as opposed
+	// to maxInFlight/MaxPendingBytes, which only free up on an ack): it
+	// fires once enough tokens will have accrued and retries delivery, so
+	// a rate-limited subscription with no backlog-driven stall keeps
+	// draining a buffered backlog instead of sitting idle until the next
+	// publish happens to retrigger it. See clearRateTimer.
+	rateTimer *time.Timer
+	ackSub    *nats.Subscription
+	// redelivery is the RedeliveryPolicy captured from
+	// channelMap.redeliveryPolicyFor(subject) when this subscription was
+	// created; see performRedelivery.
+	redelivery RedeliveryPolicy
+	// flowControl is the FlowControl captured from
+	// channelMap.flowControlFor(subject) when this subscription was created;
+	// see sendMsgToSub and allowByRate.
+	flowControl FlowControl
+	// pendingBytes is the sum of Size() for every message currently in
+	// acksPending, checked against flowControl.MaxPendingBytes. Kept in sync
+	// with acksPending by sendMsgToSub (add) and releasePending (remove).
+	pendingBytes uint64
+	// rateTokens/rateLastRefill implement a token-bucket limiter for
+	// flowControl.RateLimitBps; see allowByRate.
+	rateTokens     float64
+	rateLastRefill int64 // UnixNano
+	// pendingLimits is the PendingLimits captured from
+	// channelMap.pendingLimitsFor(subject) when this subscription was
+	// created; checked by sendMsgToSub alongside flowControl, but unlike
+	// flowControl's pure pacing, exceeding it under SlowConsumerDrop skips
+	// the message (counted in dropped) instead of stalling delivery.
+	pendingLimits PendingLimits
+	// dropped counts messages skipped because pendingLimits was exceeded
+	// under SlowConsumerDrop; see sendMsgToSub. Reported by
+	// processSubscriptionStatusRequest.
+	dropped uint64
+	// acksPending is keyed purely by sequence number. For a multi-subject
+	// subscription this assumes sequences delivered across its different
+	// channels don't collide; channels with heavy independent traffic can
+	// violate that assumption. FIXME(dlc)-style known limitation, left for
+	// a follow-up that makes this a map[string]map[uint64]*pendingMsg.
+	acksPending map[uint64]*pendingMsg
+	maxInFlight int
+	// weight is this subscription's share of a DispatchWeightedRandom
+	// queue-group selection, derived from maxInFlight (a client asking for
+	// more in-flight capacity gets proportionally more messages). Unused
+	// outside a queue group.
+	weight  int
+	stalled bool
+	// suspended is true for a durable that was Close()'d rather than
+	// Unsubscribe()'d: its acksPending state is retained, but it has no
+	// client or ackSub attached until it is resumed.
+	suspended bool
+	// pullMode is true for a queue-group member converted via a
+	// PullModeRequest: it is excluded from push dispatch
+	// (queueState.pushMembers) and from the async push side of
+	// performRedelivery, and instead retrieves messages by sending
+	// FetchRequests (see processFetchRequest). Meaningless outside a queue
+	// group.
+	pullMode bool
+	// joinSeq is this member's registration order within its queue group,
+	// assigned by subStore.Store. Only consulted when qstate.exclusive is
+	// set, to pick the oldest surviving member as the sole active one; see
+	// queueState.pushMembers.
+	joinSeq uint64
+}
+
+// earliestNextDeliverAt returns the soonest nextDeliverAt among every
+// message currently in acksPending, or 0 if it's empty. Used by processAck
+// to reset the ackTimer to the next real deadline instead of a flat
+// ackWaitInSecs, so a RedeliveryPolicy.BackOff schedule is honored across
+// acks and not just on the first redelivery. Sub lock must be held.
+func (sub *subState) earliestNextDeliverAt() int64 {
+	var earliest int64
+	for _, pm := range sub.acksPending {
+		if earliest == 0 || pm.nextDeliverAt < earliest {
+			earliest = pm.nextDeliverAt
+		}
+	}
+	return earliest
+}
+
+// releasePending removes seq from acksPending, if present, and releases its
+// bytes from pendingBytes. Sub lock must be held.
+func (sub *subState) releasePending(seq uint64) {
+	pm, ok := sub.acksPending[seq]
+	if !ok {
+		return
+	}
+	delete(sub.acksPending, seq)
+	if pm.msg == nil {
+		return
+	}
+	if sz := uint64(pm.msg.Size()); sz <= sub.pendingBytes {
+		sub.pendingBytes -= sz
+	} else {
+		sub.pendingBytes = 0
+	}
+}
+
+// allowByRate applies flowControl.RateLimitBps as a token bucket: tokens
+// accrue at RateLimitBps per second, capped at one second's worth of burst,
+// and n is only permitted (and deducted) if enough have accrued since the
+// last call. Returns true with no effect if RateLimitBps is 0 (unbounded).
+// Sub lock must be held.
+func (sub *subState) allowByRate(n int) bool {
+	bps := sub.flowControl.RateLimitBps
+	if bps == 0 {
+		return true
+	}
+
+	now := time.Now().UnixNano()
+	if sub.rateLastRefill == 0 {
+		sub.rateTokens = float64(bps)
+	} else if elapsed := float64(now-sub.rateLastRefill) / float64(time.Second); elapsed > 0 {
+		sub.rateTokens += elapsed * float64(bps)
+		if sub.rateTokens > float64(bps) {
+			sub.rateTokens = float64(bps)
+		}
+	}
+	sub.rateLastRefill = now
+
+	if sub.rateTokens < float64(n) {
+		return false
+	}
+	sub.rateTokens -= float64(n)
+	return true
+}
+
+// armRateTimer schedules a retry of delivery to sub on channel once
+// flowControl.RateLimitBps will have refilled enough tokens to cover a
+// message of size bytes, replacing any previously armed rate timer. Called
+// by sendMsgToSub right after allowByRate has refused size, so
+// sub.rateTokens/rateLastRefill already reflect the current bucket state.
+// Sub lock must be held.
+func (s *stanServer) armRateTimer(sub *subState, channel string, size int) {
+	delay := time.Millisecond
+	if bps := sub.flowControl.RateLimitBps; bps > 0 {
+		if deficit := float64(size) - sub.rateTokens; deficit > 0 {
+			delay = time.Duration(deficit/float64(bps)*float64(time.Second)) + time.Millisecond
+		}
+	}
+	sub.clearRateTimer()
+	sub.rateTimer = time.AfterFunc(delay, func() {
+		cs := s.channels.Lookup(channel)
+		if cs == nil {
+			return
+		}
+		if qs := sub.qstate; qs != nil {
+			s.sendAvailableMessagesToQueue(cs, qs)
+		} else {
+			s.sendAvailableMessages(cs, sub)
+		}
+	})
 }
 
 // Lookup or create a channel by subject
@@ -144,43 +457,209 @@ func (cm *channelMap) New(subject string) *channelStore {
 	cm.Lock()
 	defer cm.Unlock()
 	cs := &channelStore{
-		msgs: &msgStore{
-			subject: subject,
-			first:   1,
-			last:    0,
-			msgs:    make(map[uint64]*pb.MsgProto, DefaultMsgStoreLimit),
-		},
+		subject: subject,
+		msgs:    cm.newMsgStore(subject),
 		subs: &subStore{
-			psubs:    make([]*subState, 0, 4),
-			qsubs:    make(map[string]*queueState),
-			durables: make(map[string]*subState),
-			acks:     make(map[string]*subState),
+			psubs:             make([]*subState, 0, 4),
+			qsubs:             make(map[string]*queueState),
+			durables:          make(map[string]*subState),
+			acks:              make(map[string]*subState),
+			pendingQueueBinds: make(map[string]struct{}),
 		},
 	}
 	cm.channels[subject] = cs
+
+	if cm.opts != nil && len(cm.opts.ClusterPeers) > 0 {
+		cl, err := cm.startCluster(subject, cs.msgs)
+		if err != nil {
+			Errorf("STAN: failed to start cluster group for channel %q: %v", subject, err)
+		} else {
+			cs.cluster = cl
+		}
+	}
+
+	// Fan in any already-registered wildcard subscription whose filter
+	// matches this newly created channel.
+	for _, sub := range cm.wildcardSubs {
+		sub.RLock()
+		filters := sub.filters
+		sub.RUnlock()
+		for _, filter := range filters {
+			if isWildcardFilter(filter) && filterMatchesSubject(filter, subject) {
+				cs.subs.Store(sub)
+				break
+			}
+		}
+	}
+
 	return cs
 }
 
-func (ss *subStore) Store(sub *subState) {
+// registerWildcardSub records sub in cm.wildcardSubs so that future New
+// channels matching one of sub's wildcard filters pick it up automatically.
+func (cm *channelMap) registerWildcardSub(sub *subState) {
+	cm.Lock()
+	defer cm.Unlock()
+	cm.wildcardSubs = append(cm.wildcardSubs, sub)
+}
+
+// limitsFor returns the effective ChannelLimits for subject: its per-subject
+// override if one was set via stanServer.SetChannelLimits, else
+// cm.opts.ChannelLimits, else DefaultChannelLimits.
+func (cm *channelMap) limitsFor(subject string) ChannelLimits {
+	cm.RLock()
+	limits, ok := cm.subjectLimits[subject]
+	cm.RUnlock()
+	if ok {
+		return limits
+	}
+	if cm.opts != nil && cm.opts.ChannelLimits != (ChannelLimits{}) {
+		return cm.opts.ChannelLimits
+	}
+	return DefaultChannelLimits
+}
+
+// redeliveryPolicyFor returns the effective RedeliveryPolicy for subject: its
+// per-subject override if one was set via stanServer.SetRedeliveryPolicy,
+// else cm.opts.RedeliveryPolicy, else DefaultRedeliveryPolicy.
+func (cm *channelMap) redeliveryPolicyFor(subject string) RedeliveryPolicy {
+	cm.RLock()
+	rp, ok := cm.subjectRedelivery[subject]
+	cm.RUnlock()
+	if ok {
+		return rp
+	}
+	if cm.opts != nil && !cm.opts.RedeliveryPolicy.isZero() {
+		return cm.opts.RedeliveryPolicy
+	}
+	return DefaultRedeliveryPolicy
+}
+
+// dispatchPolicyFor returns the effective QueueDispatchPolicy for subject:
+// its per-subject override if one was set via
+// stanServer.SetQueueDispatchPolicy, else cm.opts.QueueDispatchPolicy, else
+// DefaultQueueDispatchPolicy.
+func (cm *channelMap) dispatchPolicyFor(subject string) QueueDispatchPolicy {
+	cm.RLock()
+	policy, ok := cm.subjectDispatch[subject]
+	cm.RUnlock()
+	if ok {
+		return policy
+	}
+	if cm.opts != nil && cm.opts.QueueDispatchPolicy != "" {
+		return cm.opts.QueueDispatchPolicy
+	}
+	return DefaultQueueDispatchPolicy
+}
+
+// flowControlFor returns the effective FlowControl for subject: its
+// per-subject override if one was set via stanServer.SetFlowControl, else
+// cm.opts.FlowControl, else DefaultFlowControl (unbounded).
+func (cm *channelMap) flowControlFor(subject string) FlowControl {
+	cm.RLock()
+	fc, ok := cm.subjectFlowControl[subject]
+	cm.RUnlock()
+	if ok {
+		return fc
+	}
+	if cm.opts != nil && !cm.opts.FlowControl.isZero() {
+		return cm.opts.FlowControl
+	}
+	return DefaultFlowControl
+}
+
+// pendingLimitsFor returns the effective PendingLimits for subject: its
+// per-subject override if one was set via stanServer.SetPendingLimits, else
+// cm.opts.PendingLimits, else DefaultPendingLimits (unbounded).
+func (cm *channelMap) pendingLimitsFor(subject string) PendingLimits {
+	cm.RLock()
+	pl, ok := cm.subjectPendingLimits[subject]
+	cm.RUnlock()
+	if ok {
+		return pl
+	}
+	if cm.opts != nil && !cm.opts.PendingLimits.isZero() {
+		return cm.opts.PendingLimits
+	}
+	return DefaultPendingLimits
+}
+
+// startCluster starts (or rejoins) the per-channel Raft group backing
+// subject's store, per ServerOptions.ClusterAddr/ClusterPeers/
+// ClusterDataDir. Only called from New when ClusterPeers is non-empty:
+// clustering is entirely opt-in, so a default/zero ServerOptions keeps
+// every channel on the original single-node path.
+func (cm *channelMap) startCluster(subject string, store Store) (*cluster.Cluster, error) {
+	cfg := cluster.Config{
+		LocalID:   cm.opts.ClusterAddr,
+		Addr:      cm.opts.ClusterAddr,
+		Peers:     cm.opts.ClusterPeers,
+		Bootstrap: true,
+		DataDir:   cluster.ChannelDataDir(cm.opts.ClusterDataDir, subject),
+	}
+	return cluster.New(cfg, cluster.NewFSM(store))
+}
+
+// newMsgStore picks the Store implementation for subject according to
+// cm.opts.StoreType, recovering it from disk first if it is a FileStore
+// that already has data for subject.
+func (cm *channelMap) newMsgStore(subject string) Store {
+	limits := cm.limitsFor(subject)
+
+	if cm.opts != nil && cm.opts.StoreType == FileStore {
+		fms, err := newFileMsgStore(cm.opts.FileStoreDir, subject)
+		if err != nil {
+			Errorf("STAN: unable to create file store for %q, falling back to memory: %v", subject, err)
+		} else {
+			fms.limits = limits
+			return fms
+		}
+	}
+	ms := &msgStore{
+		subject: subject,
+		first:   1,
+		last:    0,
+		msgs:    make(map[uint64]*pb.MsgProto, DefaultMsgStoreLimit),
+		limits:  limits,
+	}
+	ms.startAging()
+	return ms
+}
+
+// Store registers sub. For a queue subscriber whose clientID has a pending
+// bind marker (see CheckAndMarkPendingBind), it only joins an already-existing
+// group instead of creating one, returning ErrInvalidSub if the group no
+// longer has any members - checked under the same lock that would create
+// the group, so a BindQueueGroup caller can never land in a group that was
+// silently (re)created out from under it between its existence check and
+// this call.
+func (ss *subStore) Store(sub *subState) error {
 	if sub == nil {
-		return
+		return nil
 	}
 	sub.RLock()
 	ackInbox := sub.ackInbox
 	qgroup := sub.qgroup
+	clientID := sub.clientID
 	isDurable := sub.isDurable()
 	sub.RUnlock()
 
 	ss.Lock()
 	defer ss.Unlock()
 
-	// First store by ackInbox for ack direct lookup
-	ss.acks[ackInbox] = sub
-
 	// Store by type
 	if qgroup != "" {
 		// Queue subscriber.
 		qs := ss.qsubs[qgroup]
+
+		key := pendingBindKey(clientID, qgroup)
+		if _, isBind := ss.pendingQueueBinds[key]; isBind {
+			delete(ss.pendingQueueBinds, key)
+			if qs == nil {
+				return ErrInvalidSub
+			}
+		}
+
 		if qs == nil {
 			qs = &queueState{
 				subs: make([]*subState, 0, 4),
@@ -189,15 +668,78 @@ func (ss *subStore) Store(sub *subState) {
 		}
 		qs.subs = append(qs.subs, sub)
 		sub.qstate = qs
+		sub.joinSeq = qs.nextJoin
+		qs.nextJoin++
 	} else {
 		// Plain subscriber.
 		ss.psubs = append(ss.psubs, sub)
 	}
 
+	// First store by ackInbox for ack direct lookup
+	ss.acks[ackInbox] = sub
+
 	// Hold onto durables in special lookup.
 	if isDurable {
 		ss.durables[sub.durableKey()] = sub
 	}
+	return nil
+}
+
+// CheckAndMarkPendingBind is processQueueGroupRequest's atomic version of
+// "does qgroup exist": it returns ErrInvalidSub if it doesn't, and
+// otherwise records a pending bind marker for clientID in the same locked
+// section, so there is no window between the existence answer and the
+// marker Store later consumes for a gap to open back up in. A marker that
+// is never consumed (the client never follows up with the actual
+// subscribe) is simply abandoned - one clientID+qgroup pair's worth of
+// memory per abandoned bind attempt.
+func (ss *subStore) CheckAndMarkPendingBind(clientID, qgroup string) error {
+	ss.Lock()
+	defer ss.Unlock()
+	if ss.qsubs[qgroup] == nil {
+		return ErrInvalidSub
+	}
+	ss.pendingQueueBinds[pendingBindKey(clientID, qgroup)] = struct{}{}
+	return nil
+}
+
+func pendingBindKey(clientID, qgroup string) string {
+	return clientID + "\x00" + qgroup
+}
+
+// Suspend detaches the subscription from its client and stops its ack
+// timer, but leaves it registered (including in the durables lookup) so
+// that its acksPending state survives until the durable is either resumed
+// or explicitly removed via Remove.
+func (ss *subStore) Suspend(sub *subState) {
+	if sub == nil {
+		return
+	}
+
+	sub.Lock()
+	sub.clientID = ""
+	if sub.ackSub != nil {
+		sub.ackSub.Unsubscribe()
+		sub.ackSub = nil
+	}
+	sub.clearAckTimer()
+	sub.clearRateTimer()
+	sub.suspended = true
+	ackInbox := sub.ackInbox
+	qs := sub.qstate
+	sub.Unlock()
+
+	ss.Lock()
+	defer ss.Unlock()
+
+	// Drop the ackInbox lookup since a resubscribe will be issued a new
+	// ackInbox, but keep the durable/qgroup bookkeeping intact.
+	delete(ss.acks, ackInbox)
+	if qs != nil {
+		qs.subs = sub.deleteFromList(qs.subs)
+	} else {
+		ss.psubs = sub.deleteFromList(ss.psubs)
+	}
 }
 
 // Remove
@@ -210,8 +752,10 @@ func (ss *subStore) Remove(sub *subState) {
 	// Clear the subscriptions clientID
 	sub.clientID = ""
 	sub.ackSub.Unsubscribe()
+	sub.clearRateTimer()
 	ackInbox := sub.ackInbox
 	qs := sub.qstate
+	qgroup := sub.qgroup
 	durable := sub.durableName
 	sub.Unlock()
 
@@ -229,6 +773,17 @@ func (ss *subStore) Remove(sub *subState) {
 	// Delete ourselves from the list
 	if qs != nil {
 		qs.subs = sub.deleteFromList(qs.subs)
+		// Remove (unlike Suspend) always means sub is gone for good, even
+		// for a durable queue member - see processUnSubscribeRequest vs.
+		// processSubCloseRequest. Once the group has no members left, drop
+		// its entry entirely (not just its subs slice) so a later
+		// CheckAndMarkPendingBind/Store correctly reports the name as
+		// unused rather than matching a drained group that happens to
+		// share it, and so the drained group's exclusive/joinSeq state
+		// doesn't leak into whatever new group reuses the name.
+		if len(qs.subs) == 0 {
+			delete(ss.qsubs, qgroup)
+		}
 	} else {
 		ss.psubs = sub.deleteFromList(ss.psubs)
 	}
@@ -248,13 +803,279 @@ func (ss *subStore) LookupByAckInbox(ackInbox string) *subState {
 	return ss.acks[ackInbox]
 }
 
+// LookupQueueState returns the queueState for qgroup, or nil if no member
+// has subscribed under that name yet.
+func (ss *subStore) LookupQueueState(qgroup string) *queueState {
+	ss.RLock()
+	defer ss.RUnlock()
+	return ss.qsubs[qgroup]
+}
+
+// ChannelLimits caps how much a single channel's message store may hold.
+// A zero value for any field means that policy is not enforced; Store still
+// falls back to DefaultMsgStoreLimit for MaxMsgs in that case so a channel
+// with no limits configured doesn't grow unbounded.
+type ChannelLimits struct {
+	MaxMsgs  int
+	MaxBytes uint64
+	MaxAge   time.Duration
+}
+
+// DefaultChannelLimits is used for any channel that has no per-subject
+// override and ServerOptions.ChannelLimits is the zero value.
+var DefaultChannelLimits = ChannelLimits{MaxMsgs: DefaultMsgStoreLimit}
+
+// RedeliveryPolicy controls how many times, and how often, an unacked
+// message is redelivered to a subscription.
+type RedeliveryPolicy struct {
+	// MaxDeliver caps the number of delivery attempts for a message; once
+	// exceeded the message is dropped from acksPending instead of being
+	// redelivered again. Zero means unlimited, matching the pre-existing
+	// behavior of redelivering forever at ackWaitInSecs.
+	MaxDeliver int
+	// BackOff gives the wait before each successive redelivery attempt:
+	// BackOff[0] before the 2nd delivery, BackOff[1] before the 3rd, and so
+	// on, holding at BackOff[len(BackOff)-1] for any attempt beyond that. An
+	// empty BackOff falls back to the subscription's flat ackWaitInSecs,
+	// unchanged from before this existed. Takes priority over
+	// InitialWait/MaxWait/Multiplier/Jitter below if both are set.
+	BackOff []time.Duration
+	// InitialWait, MaxWait, Multiplier and Jitter configure exponential
+	// backoff with jitter as an alternative to an explicit BackOff
+	// schedule, for when the number of delivery attempts isn't known in
+	// advance: the wait before the deliveries-th redelivery is
+	// min(MaxWait, InitialWait * Multiplier^(deliveries-1)) plus a
+	// uniform random value in [-Jitter, +Jitter]. Only takes effect when
+	// InitialWait is non-zero and BackOff is empty. Multiplier less than 1
+	// is treated as 1 (no growth); MaxWait of 0 means no cap.
+	InitialWait time.Duration
+	MaxWait     time.Duration
+	Multiplier  float64
+	Jitter      time.Duration
+	// DeadLetterSubject, if set, receives a copy of any message dropped
+	// after MaxDeliver attempts, so applications can still act on poison
+	// messages instead of silently losing them.
+	DeadLetterSubject string
+}
+
+// DefaultRedeliveryPolicy redelivers forever at the subscription's flat
+// ackWaitInSecs, the behavior before RedeliveryPolicy existed.
+var DefaultRedeliveryPolicy = RedeliveryPolicy{}
+
+// DeadLetterMessage is what gets stored to a RedeliveryPolicy.DeadLetterSubject
+// channel for a message dropped after MaxDeliver attempts: the original
+// message's Data plus enough metadata to tell why it ended up here. JSON
+// rather than a pb type since, like SubscriptionStatusRequest, it has no
+// corresponding message in the vendored pb package.
+type DeadLetterMessage struct {
+	Subject    string
+	Sequence   uint64
+	Timestamp  int64
+	Data       []byte
+	Deliveries int
+	// QueueGroup and ClientID identify which queue group, and which member
+	// of it, gave up on the message; QueueGroup is empty for a non-queue
+	// subscription.
+	QueueGroup string
+	ClientID   string
+}
+
+// storeDeadLetter marshals a DeadLetterMessage for m and stores it to
+// deadLetterSubject through the normal publish path (same
+// channelMap.LookupOrCreate + msgs.Store assignAndStore itself uses), so the
+// dead-letter subject is an ordinary channel a consumer can Subscribe to
+// rather than a one-off out-of-band NATS publish.
+func (s *stanServer) storeDeadLetter(deadLetterSubject string, m *pb.MsgProto, deliveries int, qgroup, clientID string) {
+	dlm := &DeadLetterMessage{
+		Subject:    m.Subject,
+		Sequence:   m.Sequence,
+		Timestamp:  m.Timestamp,
+		Data:       m.Data,
+		Deliveries: deliveries,
+		QueueGroup: qgroup,
+		ClientID:   clientID,
+	}
+	b, err := json.Marshal(dlm)
+	if err != nil {
+		Errorf("STAN: failed to marshal dead letter for subject=%s seqno=%d: %v", m.Subject, m.Sequence, err)
+		return
+	}
+	cs := s.channels.LookupOrCreate(deadLetterSubject)
+	if cs.cluster != nil {
+		cmd := cluster.Command{Op: cluster.OpStore, Subject: deadLetterSubject, Data: b}
+		if _, err := cs.cluster.Propose(cmd); err != nil {
+			Errorf("STAN: failed to replicate dead letter store on %q: %v", deadLetterSubject, err)
+		}
+		return
+	}
+	if _, err := cs.msgs.Store(deadLetterSubject, "", b); err != nil {
+		Errorf("STAN: failed to store dead letter on %q: %v", deadLetterSubject, err)
+	}
+}
+
+// isZero reports whether rp is the unconfigured zero value. RedeliveryPolicy
+// has a slice field so it isn't comparable with ==, unlike ChannelLimits.
+func (rp RedeliveryPolicy) isZero() bool {
+	return rp.MaxDeliver == 0 && len(rp.BackOff) == 0 && rp.InitialWait == 0 && rp.DeadLetterSubject == ""
+}
+
+// backOffFor returns how long to wait before the deliveries-th redelivery
+// attempt (deliveries is the count of attempts made so far, including the
+// one that just failed to be acked), or 0 if neither BackOff nor
+// InitialWait is configured, in which case the caller should fall back to
+// the flat ackWaitInSecs.
+func (rp RedeliveryPolicy) backOffFor(deliveries int) time.Duration {
+	if len(rp.BackOff) > 0 {
+		idx := deliveries - 1
+		if idx < 0 {
+			idx = 0
+		}
+		if idx >= len(rp.BackOff) {
+			idx = len(rp.BackOff) - 1
+		}
+		return rp.BackOff[idx]
+	}
+	if rp.InitialWait == 0 {
+		return 0
+	}
+	attempts := deliveries - 1
+	if attempts < 0 {
+		attempts = 0
+	}
+	mult := rp.Multiplier
+	if mult < 1 {
+		mult = 1
+	}
+	jitter := rp.Jitter
+	if jitter < 0 {
+		jitter = 0
+	}
+	wait := float64(rp.InitialWait) * math.Pow(mult, float64(attempts))
+	maxWait := float64(rp.MaxWait)
+	if rp.MaxWait <= 0 || maxWait > float64(math.MaxInt64) {
+		// No cap configured, or the configured cap itself can't even be
+		// represented as a Duration: fall back to the largest
+		// representable Duration so the float64->Duration conversion
+		// below can't overflow into a bogus (commonly negative) value.
+		maxWait = float64(math.MaxInt64)
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	d := time.Duration(wait)
+	if jitter > 0 {
+		d += time.Duration(rand.Int63n(2*int64(jitter)+1)) - jitter
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// pendingMsg wraps a message awaiting acknowledgement with the bookkeeping
+// RedeliveryPolicy needs: how many times it has been delivered so far, and
+// when it is next eligible for redelivery.
+type pendingMsg struct {
+	msg           *pb.MsgProto
+	deliveries    int
+	nextDeliverAt int64 // UnixNano
+}
+
+// QueueDispatchPolicy selects which member of a queue group receives the
+// next message; see queueState.findBestQueueSub.
+type QueueDispatchPolicy string
+
+// The supported QueueDispatchPolicy values.
+const (
+	// DispatchLeastOutstanding always picks whichever member currently has
+	// the fewest unacked (acksPending) messages. This is the original
+	// findBestQueueSub behavior and the default.
+	DispatchLeastOutstanding QueueDispatchPolicy = "LEAST_OUTSTANDING"
+	// DispatchRoundRobin cycles through members in registration order,
+	// skipping any that are already at maxInFlight.
+	DispatchRoundRobin QueueDispatchPolicy = "ROUND_ROBIN"
+	// DispatchWeightedRandom picks randomly among members not at
+	// maxInFlight, weighted by each member's weight (see subState.weight).
+	DispatchWeightedRandom QueueDispatchPolicy = "WEIGHTED_RANDOM"
+)
+
+// DefaultQueueDispatchPolicy preserves the original findBestQueueSub
+// behavior for any queue group with no override configured.
+const DefaultQueueDispatchPolicy = DispatchLeastOutstanding
+
+// FlowControl bounds how fast a subscription is allowed to receive
+// messages, mirroring the external stan Subscription's
+// SetPendingLimits(msgLimit, bytesLimit) except enforced server-side on
+// every delivery attempt rather than only held client-side: MaxPendingBytes
+// caps outstanding (sent but not yet acked) bytes, and RateLimitBps is a
+// token-bucket bytes/second cap (see subState.allowByRate). Either field
+// left at 0 means that cap is unbounded; MaxInFlight (subState.maxInFlight)
+// continues to cap the outstanding message *count* independently of both.
+type FlowControl struct {
+	MaxPendingBytes uint64
+	RateLimitBps    uint64
+}
+
+// isZero reports whether fc has neither cap set.
+func (fc FlowControl) isZero() bool {
+	return fc.MaxPendingBytes == 0 && fc.RateLimitBps == 0
+}
+
+// DefaultFlowControl leaves subscriptions unbounded, the pre-existing
+// behavior.
+var DefaultFlowControl = FlowControl{}
+
+// SlowConsumerPolicy selects what happens once a subscription exceeds its
+// PendingLimits: SlowConsumerBlock stalls delivery the same way
+// maxInFlight/FlowControl already do (wait for acks to free up room),
+// while SlowConsumerDrop skips the message - advancing lastSent past it
+// so the subscription is never stuck waiting on a backlog it'll never
+// clear - and counts it in subState.dropped.
+type SlowConsumerPolicy string
+
+const (
+	SlowConsumerBlock SlowConsumerPolicy = "BLOCK"
+	SlowConsumerDrop  SlowConsumerPolicy = "DROP"
+)
+
+// DefaultSlowConsumerPolicy preserves the pre-existing stall-and-wait
+// behavior for any subscription with no PendingLimits override configured.
+const DefaultSlowConsumerPolicy = SlowConsumerBlock
+
+// PendingLimits bounds how far behind a subscription may fall before
+// SlowConsumerPolicy kicks in, mirroring the external stan Subscription's
+// SetPendingLimits(msgLimit, bytesLimit) API (MsgLimit is the message-count
+// analog of FlowControl.MaxPendingBytes' byte count). Either limit left at
+// 0 means that cap is unbounded.
+type PendingLimits struct {
+	MsgLimit   int
+	BytesLimit uint64
+	Policy     SlowConsumerPolicy
+}
+
+// isZero reports whether pl has neither limit set.
+func (pl PendingLimits) isZero() bool {
+	return pl.MsgLimit == 0 && pl.BytesLimit == 0
+}
+
+// DefaultPendingLimits leaves subscriptions unbounded, the pre-existing
+// behavior.
+var DefaultPendingLimits = PendingLimits{}
+
+// defaultAgingInterval is how often a channel with MaxAge set checks for
+// messages to expire.
+const defaultAgingInterval = time.Minute
+
 // Per channel/subject message store
 type msgStore struct {
 	sync.RWMutex
-	subject string // Can't be wildcard
-	first   uint64
-	last    uint64
-	msgs    map[uint64]*pb.MsgProto
+	subject   string // Can't be wildcard
+	first     uint64
+	last      uint64
+	msgs      map[uint64]*pb.MsgProto
+	bytes     uint64
+	limits    ChannelLimits
+	stopAging chan struct{}
 }
 
 // Store a given message
@@ -271,15 +1092,129 @@ func (ms *msgStore) Store(subject, reply string, data []byte) (*pb.MsgProto, err
 		Timestamp: time.Now().UnixNano(),
 	}
 	ms.msgs[ms.last] = m
+	ms.bytes += uint64(m.Size())
+
+	ms.trimLocked()
 
-	// Check if we need to remove any.
-	if len(ms.msgs) > DefaultMsgStoreLimit {
-		Errorf("WARNING: Removing message[%d] from the store for [`%s`]", ms.first, subject)
-		delete(ms.msgs, ms.first)
+	return m, nil
+}
+
+// trimLocked evicts the oldest messages until none of the configured
+// MaxMsgs/MaxBytes limits are exceeded. Callers must hold ms.Lock().
+func (ms *msgStore) trimLocked() {
+	maxMsgs := ms.limits.MaxMsgs
+	if maxMsgs == 0 {
+		maxMsgs = DefaultMsgStoreLimit
+	}
+
+	for len(ms.msgs) > maxMsgs || (ms.limits.MaxBytes > 0 && ms.bytes > ms.limits.MaxBytes) {
+		if len(ms.msgs) == 0 {
+			break
+		}
+		ms.evictLocked(ms.first)
+	}
+}
+
+// evictLocked removes seq from the store, adjusting ms.first/ms.bytes.
+// Callers must hold ms.Lock().
+func (ms *msgStore) evictLocked(seq uint64) {
+	m, ok := ms.msgs[seq]
+	if !ok {
+		return
+	}
+	Errorf("WARNING: Removing message[%d] from the store for [`%s`]", seq, ms.subject)
+	delete(ms.msgs, seq)
+	ms.bytes -= uint64(m.Size())
+	if seq == ms.first {
 		ms.first++
+		for ms.first <= ms.last {
+			if _, ok := ms.msgs[ms.first]; ok {
+				break
+			}
+			ms.first++
+		}
+	}
+}
+
+// expireByAge evicts every message older than ms.limits.MaxAge. It is safe
+// to call even if MaxAge is zero (it is then a no-op).
+func (ms *msgStore) expireByAge() {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if ms.limits.MaxAge <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-ms.limits.MaxAge).UnixNano()
+	for seq := ms.first; seq <= ms.last; seq++ {
+		m, ok := ms.msgs[seq]
+		if !ok {
+			continue
+		}
+		if m.Timestamp >= cutoff {
+			break
+		}
+		ms.evictLocked(seq)
 	}
+}
 
-	return m, nil
+// startAging launches the background goroutine that periodically expires
+// messages older than ms.limits.MaxAge. It is a no-op if MaxAge is zero.
+// The goroutine exits when ms.stopAging is closed (see stanServer.Shutdown).
+func (ms *msgStore) startAging() {
+	if ms.limits.MaxAge <= 0 {
+		return
+	}
+	ms.stopAging = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(defaultAgingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ms.expireByAge()
+			case <-ms.stopAging:
+				return
+			}
+		}
+	}()
+}
+
+// Usage reports the current message count, byte usage and effective limits
+// for the channel, so operators can tune per-channel limits.
+func (ms *msgStore) Usage() (count int, bytes uint64, limits ChannelLimits) {
+	ms.RLock()
+	defer ms.RUnlock()
+	return len(ms.msgs), ms.bytes, ms.limits
+}
+
+// setLimits updates ms.limits, re-trims under the new MaxMsgs/MaxBytes, and
+// restarts the aging goroutine to pick up a new MaxAge.
+func (ms *msgStore) setLimits(limits ChannelLimits) {
+	ms.Lock()
+	ms.limits = limits
+	ms.trimLocked()
+	stop := ms.stopAging
+	ms.stopAging = nil
+	ms.Unlock()
+
+	if stop != nil {
+		close(stop)
+	}
+	ms.startAging()
+}
+
+// Close stops the aging goroutine, if one is running.
+func (ms *msgStore) Close() error {
+	ms.Lock()
+	stop := ms.stopAging
+	ms.stopAging = nil
+	ms.Unlock()
+
+	if stop != nil {
+		close(stop)
+	}
+	return nil
 }
 
 // Return sequence for first message stored.
@@ -315,14 +1250,188 @@ func (ms *msgStore) LastMsg() *pb.MsgProto {
 	return ms.msgs[ms.last]
 }
 
+// Msgs returns up to count messages starting at fromSeq, in sequence
+// order, skipping any sequence that has already been evicted.
+func (ms *msgStore) Msgs(fromSeq uint64, count int) []*pb.MsgProto {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	res := make([]*pb.MsgProto, 0, count)
+	for seq := fromSeq; seq <= ms.last && len(res) < count; seq++ {
+		if m := ms.msgs[seq]; m != nil {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// Store is the contract a per-channel message store backend must satisfy.
+// msgStore (in-memory, the default) and fileMsgStore (file.go) both
+// implement it; which one channelMap.New uses is picked by
+// ServerOptions.StoreType.
+type Store interface {
+	// Store stores a message and returns its assigned sequence.
+	Store(subject, reply string, data []byte) (*pb.MsgProto, error)
+	// Lookup returns the message stored under seq, or nil.
+	Lookup(seq uint64) *pb.MsgProto
+	// FirstSequence returns the sequence of the first message stored.
+	FirstSequence() uint64
+	// LastSequence returns the sequence of the last message stored.
+	LastSequence() uint64
+	// Msgs returns up to count messages starting at fromSeq.
+	Msgs(fromSeq uint64, count int) []*pb.MsgProto
+	// FirstMsg returns the first message stored, or nil.
+	FirstMsg() *pb.MsgProto
+	// LastMsg returns the last message stored, or nil.
+	LastMsg() *pb.MsgProto
+	// Usage reports the current message count, byte usage and effective
+	// ChannelLimits for the channel.
+	Usage() (count int, bytes uint64, limits ChannelLimits)
+	// setLimits updates the ChannelLimits applied by future Store calls
+	// and triggers an immediate trim under the new limits.
+	setLimits(limits ChannelLimits)
+	// Close releases any resources (aging goroutine, open file) held by
+	// the store.
+	Close() error
+}
+
+// StoreType selects which Store implementation backs a channel's messages.
+type StoreType string
+
+// The supported StoreType values.
+const (
+	// MemoryStore keeps all messages in memory; nothing survives a restart.
+	MemoryStore StoreType = "MEMORY"
+	// FileStore persists messages to append-only segment files under
+	// ServerOptions.FileStoreDir, so durables and message history survive
+	// a server restart. See file.go.
+	FileStore StoreType = "FILE"
+)
+
 // ServerOptions
 type ServerOptions struct {
 	DiscoverPrefix string
+
+	// StoreType selects the Store implementation used for every channel.
+	// Defaults to MemoryStore.
+	StoreType StoreType
+	// FileStoreDir is the directory holding one <channel>.dat file per
+	// channel when StoreType is FileStore. Ignored otherwise.
+	FileStoreDir string
+
+	// ChannelLimits is applied to every channel that has no per-subject
+	// override set via stanServer.SetChannelLimits.
+	ChannelLimits ChannelLimits
+
+	// RedeliveryPolicy is applied to every subscription on a channel that
+	// has no per-subject override set via stanServer.SetRedeliveryPolicy.
+	RedeliveryPolicy RedeliveryPolicy
+
+	// QueueDispatchPolicy is applied to every queue group that has no
+	// per-subject override set via stanServer.SetQueueDispatchPolicy.
+	QueueDispatchPolicy QueueDispatchPolicy
+
+	// FlowControl is applied to every subscription on a channel that has no
+	// per-subject override set via stanServer.SetFlowControl.
+	FlowControl FlowControl
+
+	// PendingLimits is applied to every subscription on a channel that has
+	// no per-subject override set via stanServer.SetPendingLimits.
+	PendingLimits PendingLimits
+
+	// ClusterPeers lists the Raft addresses of every other node in this
+	// server's cluster. Leaving it empty (the default) keeps every channel
+	// on the original single-node path: clustering is entirely opt-in. See
+	// cluster.Config.
+	ClusterPeers []string
+	// ClusterAddr is this node's own Raft address, advertised to ClusterPeers.
+	ClusterAddr string
+	// ClusterDataDir holds each channel's Raft snapshots, one subdirectory
+	// per channel; see cluster.ChannelDataDir.
+	ClusterDataDir string
+
+	// MonitorAddr, if set, starts a server.Monitor (see the server
+	// subpackage) listening on this address for the lifetime of the
+	// server - metrics, health/ready probes and the channel/client
+	// listing endpoints described there. Left empty (the default) leaves
+	// monitoring entirely opt-in, the same convention ClusterAddr uses.
+	MonitorAddr string
 }
 
 // Set the default discover prefix.
 var DefaultServerOptions = ServerOptions{
 	DiscoverPrefix: DefaultDiscoverPrefix,
+	StoreType:      MemoryStore,
+	ChannelLimits:  DefaultChannelLimits,
+}
+
+// SetChannelLimits sets a per-subject override for ChannelLimits, applied
+// immediately to subject's store if the channel already exists (future
+// channels created for subject pick it up from channelMap.limitsFor).
+func (s *stanServer) SetChannelLimits(subject string, limits ChannelLimits) {
+	s.channels.Lock()
+	if s.channels.subjectLimits == nil {
+		s.channels.subjectLimits = make(map[string]ChannelLimits)
+	}
+	s.channels.subjectLimits[subject] = limits
+	cs := s.channels.channels[subject]
+	s.channels.Unlock()
+
+	if cs != nil {
+		cs.msgs.setLimits(limits)
+	}
+}
+
+// SetRedeliveryPolicy sets a per-subject override for RedeliveryPolicy.
+// Unlike SetChannelLimits it only takes effect for subscriptions made after
+// the call: it's captured on subState at subscribe time (see
+// processSubscriptionRequest), not re-read on every redelivery.
+func (s *stanServer) SetRedeliveryPolicy(subject string, policy RedeliveryPolicy) {
+	s.channels.Lock()
+	if s.channels.subjectRedelivery == nil {
+		s.channels.subjectRedelivery = make(map[string]RedeliveryPolicy)
+	}
+	s.channels.subjectRedelivery[subject] = policy
+	s.channels.Unlock()
+}
+
+// SetQueueDispatchPolicy sets a per-subject override for
+// QueueDispatchPolicy. Like SetRedeliveryPolicy, it only takes effect for
+// queue groups formed after the call: a group's policy is captured on
+// queueState when its first member subscribes.
+func (s *stanServer) SetQueueDispatchPolicy(subject string, policy QueueDispatchPolicy) {
+	s.channels.Lock()
+	if s.channels.subjectDispatch == nil {
+		s.channels.subjectDispatch = make(map[string]QueueDispatchPolicy)
+	}
+	s.channels.subjectDispatch[subject] = policy
+	s.channels.Unlock()
+}
+
+// SetFlowControl sets a per-subject override for FlowControl. Like
+// SetRedeliveryPolicy, it only takes effect for subscriptions made after the
+// call: it's captured on subState at subscribe time (see
+// processSubscriptionRequest), not re-read on every delivery.
+func (s *stanServer) SetFlowControl(subject string, fc FlowControl) {
+	s.channels.Lock()
+	if s.channels.subjectFlowControl == nil {
+		s.channels.subjectFlowControl = make(map[string]FlowControl)
+	}
+	s.channels.subjectFlowControl[subject] = fc
+	s.channels.Unlock()
+}
+
+// SetPendingLimits sets a per-subject override for PendingLimits. Like
+// SetFlowControl, it only takes effect for subscriptions made after the
+// call: it's captured on subState at subscribe time (see
+// processSubscriptionRequest), not re-read on every delivery.
+func (s *stanServer) SetPendingLimits(subject string, limits PendingLimits) {
+	s.channels.Lock()
+	if s.channels.subjectPendingLimits == nil {
+		s.channels.subjectPendingLimits = make(map[string]PendingLimits)
+	}
+	s.channels.subjectPendingLimits[subject] = limits
+	s.channels.Unlock()
 }
 
 func stanDisconnectedHandler(nc *nats.Conn) {
@@ -355,21 +1464,39 @@ func EnableDefaultLogger(opts *server.Options) {
 
 // RunServer will startup and embedded STAN server and a nats-server to support it.
 func RunServer(ID string, optsA ...*server.Options) *stanServer {
+	return RunServerWithOpts(ID, &DefaultServerOptions, optsA...)
+}
+
+// RunServerWithOpts is RunServer but lets the caller pick a ServerOptions,
+// e.g. to select StoreType.
+func RunServerWithOpts(ID string, sOpts *ServerOptions, optsA ...*server.Options) *stanServer {
 	// Run a nats server by default
-	s := stanServer{clusterID: ID, serverID: nuid.Next(), opts: &DefaultServerOptions}
+	s := stanServer{clusterID: ID, serverID: nuid.Next(), opts: sOpts, clock: realClock{}}
 
 	// Create clientStore
 	s.clients = &clientStore{clients: make(map[string]*client)}
 
 	// Create channelMap
-	s.channels = &channelMap{channels: make(map[string]*channelStore)}
+	s.channels = &channelMap{channels: make(map[string]*channelStore), opts: sOpts}
 
 	// Generate Subjects
 	// FIXME(dlc) guid needs to be shared in cluster mode
 	s.pubPrefix = fmt.Sprintf("%s.%s", DefaultPubPrefix, nuid.Next())
 	s.subRequests = fmt.Sprintf("%s.%s", DefaultSubPrefix, nuid.Next())
 	s.unsubRequests = fmt.Sprintf("%s.%s", DefaultUnSubPrefix, nuid.Next())
+	s.subCloseRequests = fmt.Sprintf("%s.%s", DefaultSubClosePrefix, nuid.Next())
 	s.closeRequests = fmt.Sprintf("%s.%s", DefaultClosePrefix, nuid.Next())
+	s.pingRequests = fmt.Sprintf("%s.%s", DefaultPingPrefix, nuid.Next())
+	s.subStatusRequests = fmt.Sprintf("%s.%s", DefaultSubStatusPrefix, nuid.Next())
+	s.pullConvertRequests = fmt.Sprintf("%s.%s", DefaultPullConvertPrefix, nuid.Next())
+	s.fetchRequests = fmt.Sprintf("%s.%s", DefaultFetchPrefix, nuid.Next())
+	// No nuid suffix here, unlike the other generated subjects above: see
+	// DefaultExclusiveQueuePrefix for why this one has to be deterministic.
+	s.exclusiveQueueRequests = fmt.Sprintf("%s.%s", DefaultExclusiveQueuePrefix, s.clusterID)
+	// Deterministic for the same reason exclusiveQueueRequests is: a
+	// BindQueueGroup caller needs to reach this before it has subscribed to
+	// anything, so there is no ConnectResponse-delivered subject to hand it.
+	s.queueGroupRequests = fmt.Sprintf("%s.%s", DefaultQueueGroupPrefix, s.clusterID)
 
 	// hack
 	var opts *server.Options
@@ -392,6 +1519,7 @@ func RunServer(ID string, optsA ...*server.Options) *stanServer {
 	nats.ClosedHandler(stanClosedHandler)
 
 	s.initSubscriptions()
+	s.startMonitor()
 
 	Noticef("STAN: Message store is MEMORY")
 	Noticef("STAN: Maximum of %d will be stored", DefaultMsgStoreLimit)
@@ -423,17 +1551,59 @@ func (s *stanServer) initSubscriptions() {
 	if err != nil {
 		panic(fmt.Sprintf("Could not subscribe to unsubscribe request subject, %v\n", err))
 	}
+	// Receive subscription close (suspend) requests from clients.
+	_, err = s.nc.Subscribe(s.subCloseRequests, s.processSubCloseRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to subscription close request subject, %v\n", err))
+	}
 	// Receive close requests from clients.
 	_, err = s.nc.Subscribe(s.closeRequests, s.processCloseRequest)
 	if err != nil {
 		panic(fmt.Sprintf("Could not subscribe to close request subject, %v\n", err))
 	}
-
-	Debugf("STAN: discover subject: %s", discoverSubject)
+	// Receive client-to-server pings.
+	_, err = s.nc.Subscribe(s.pingRequests, s.processPingRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to ping subject, %v\n", err))
+	}
+	// Receive subscription status (Pending/Dropped) requests.
+	_, err = s.nc.Subscribe(s.subStatusRequests, s.processSubscriptionStatusRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to subscription status subject, %v\n", err))
+	}
+	// Receive requests to convert a queue-group member to pull mode.
+	_, err = s.nc.Subscribe(s.pullConvertRequests, s.processPullModeRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to pull mode conversion subject, %v\n", err))
+	}
+	// Receive Fetch requests from pull-mode queue members.
+	_, err = s.nc.Subscribe(s.fetchRequests, s.processFetchRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to fetch subject, %v\n", err))
+	}
+	// Receive requests to mark a queue group exclusive (single-active).
+	_, err = s.nc.Subscribe(s.exclusiveQueueRequests, s.processExclusiveQueueRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to exclusive queue subject, %v\n", err))
+	}
+	// Receive requests to check whether a queue group already exists, for
+	// stan.BindQueueGroup.
+	_, err = s.nc.Subscribe(s.queueGroupRequests, s.processQueueGroupRequest)
+	if err != nil {
+		panic(fmt.Sprintf("Could not subscribe to queue group subject, %v\n", err))
+	}
+
+	Debugf("STAN: discover subject: %s", discoverSubject)
 	Debugf("STAN: publish subject:  %s", pubSubject)
 	Debugf("STAN: subcribe subject: %s", s.subRequests)
 	Debugf("STAN: unsub subject:    %s", s.unsubRequests)
 	Debugf("STAN: close subject:    %s", s.closeRequests)
+	Debugf("STAN: ping subject:     %s", s.pingRequests)
+	Debugf("STAN: sub status subject: %s", s.subStatusRequests)
+	Debugf("STAN: pull convert subject: %s", s.pullConvertRequests)
+	Debugf("STAN: fetch subject: %s", s.fetchRequests)
+	Debugf("STAN: exclusive queue subject: %s", s.exclusiveQueueRequests)
+	Debugf("STAN: queue group subject: %s", s.queueGroupRequests)
 
 }
 
@@ -467,10 +1637,12 @@ func (s *stanServer) connectCB(m *nats.Msg) {
 
 	// Respond with our ConnectResponse
 	cr := &pb.ConnectResponse{
-		PubPrefix:     s.pubPrefix,
-		SubRequests:   s.subRequests,
-		UnsubRequests: s.unsubRequests,
-		CloseRequests: s.closeRequests,
+		PubPrefix:        s.pubPrefix,
+		SubRequests:      s.subRequests,
+		UnsubRequests:    s.unsubRequests,
+		SubCloseRequests: s.subCloseRequests,
+		CloseRequests:    s.closeRequests,
+		PingRequests:     s.pingRequests,
 	}
 	b, _ := cr.Marshal()
 	s.nc.Publish(m.Reply, b)
@@ -553,20 +1725,23 @@ func (s *stanServer) processClientPublish(m *nats.Msg) {
 	}
 
 	////////////////////////////////////////////////////////////////////////////
-	// This is where we will store the message and wait for others in the
-	// potential cluster to do so as well, once we have a quorom someone can
-	// ack the publisher. We simply do so here for now.
+	// Assign this a sequence ID and store it - in cluster mode this proposes
+	// the write to the channel's Raft leader and waits for it to commit.
+	// Only once that has actually succeeded do we ack the publisher, so a
+	// client never sees a successful ack for a message that wasn't stored.
 	////////////////////////////////////////////////////////////////////////////
 
-	s.ackPublisher(pm, m.Reply)
-
-	////////////////////////////////////////////////////////////////////////////
-	// Once we have ack'd the publisher, we need to assign this a sequence ID.
-	// This will be done by a master election within the cluster, for now we
-	// assume we are the master and assign the sequence ID here.
-	////////////////////////////////////////////////////////////////////////////
+	cs, err := s.assignAndStore(pm)
+	if err != nil {
+		Errorf("STAN: [Client:%s] Failed to store message on subject %s: %v", pm.ClientID, pm.Subject, err)
+		nak := &pb.PubAck{Guid: pm.Guid, Error: err.Error()}
+		if b, merr := nak.Marshal(); merr == nil {
+			s.nc.Publish(m.Reply, b)
+		}
+		return
+	}
 
-	cs := s.assignAndStore(pm)
+	s.ackPublisher(pm, m.Reply)
 
 	////////////////////////////////////////////////////////////////////////////
 	// Now trigger sends to any active subscribers
@@ -575,10 +1750,151 @@ func (s *stanServer) processClientPublish(m *nats.Msg) {
 	s.processMsg(cs)
 }
 
-// FIXME(dlc) - place holder to pick sub that has least outstanding, should just sort,
-// or use insertion sort, etc.
-func findBestQueueSub(sl []*subState) (rsub *subState) {
-	for _, sub := range sl {
+// pushMembers returns the members of the group eligible for async push
+// dispatch, excluding any converted to pull mode by a PullModeRequest (see
+// subState.pullMode). A pull-mode member only ever receives a message in
+// response to its own FetchRequest (see processFetchRequest), so it must
+// never be selected here.
+//
+// If the group is exclusive (see queueState.exclusive, stan.ExclusiveQueue),
+// this narrows further to just the single active member: whichever
+// push-eligible member has the lowest joinSeq. Since joinSeq is assigned in
+// registration order and never reassigned, this is always "the first member,
+// or the oldest surviving one" with no extra failover bookkeeping needed -
+// the active member simply changes to whichever survivor is now lowest the
+// moment the previous one is removed (see transferExclusiveQueuePending for
+// what happens to its pending messages when that happens).
+func (qs *queueState) pushMembers() []*subState {
+	members := make([]*subState, 0, len(qs.subs))
+	for _, sub := range qs.subs {
+		sub.RLock()
+		pull := sub.pullMode
+		sub.RUnlock()
+		if !pull {
+			members = append(members, sub)
+		}
+	}
+	if !qs.exclusive || len(members) == 0 {
+		return members
+	}
+	active := members[0]
+	for _, sub := range members[1:] {
+		if sub.joinSeq < active.joinSeq {
+			active = sub
+		}
+	}
+	return []*subState{active}
+}
+
+// addWaiter registers a wake-up channel for a blocking FetchRequest,
+// returned along with a remove func the caller must call once it stops
+// waiting (whether woken or timed out). Takes qs's lock itself.
+func (qs *queueState) addWaiter() (ch chan struct{}, remove func()) {
+	qs.Lock()
+	ch = make(chan struct{}, 1)
+	qs.waiters = append(qs.waiters, ch)
+	qs.Unlock()
+
+	remove = func() {
+		qs.Lock()
+		for i, w := range qs.waiters {
+			if w == ch {
+				qs.waiters = append(qs.waiters[:i], qs.waiters[i+1:]...)
+				break
+			}
+		}
+		qs.Unlock()
+	}
+	return ch, remove
+}
+
+// notifyWaiters wakes every FetchRequest currently blocked in addWaiter, so
+// it re-checks for newly available messages instead of waiting out its full
+// MaxWait. qs lock must be held by the caller.
+func (qs *queueState) notifyWaiters() {
+	for _, w := range qs.waiters {
+		select {
+		case w <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// findBestQueueSub selects which push-eligible member of the group should
+// receive the next message, according to qs.dispatchPolicy
+// (DefaultQueueDispatchPolicy if unset). Returns nil if every member is
+// pull-mode (see pushMembers); the message stays available for pull members
+// to retrieve via FetchRequest instead.
+func (qs *queueState) findBestQueueSub() *subState {
+	policy := qs.dispatchPolicy
+	if policy == "" {
+		policy = DefaultQueueDispatchPolicy
+	}
+
+	switch policy {
+	case DispatchRoundRobin:
+		return qs.findRoundRobinSub()
+	case DispatchWeightedRandom:
+		return qs.findWeightedRandomSub()
+	default:
+		return qs.findLeastOutstandingSub()
+	}
+}
+
+// minInitialWait returns the lowest RedeliveryPolicy.InitialWait configured
+// across qs's current members, or 0 if none have one set. A message
+// reassigned from a fast-retrying member to a slower one (performRedelivery's
+// queue-group reassignment, transferExclusiveQueuePending) uses its new
+// owner's own policy like any other redelivery, but that alone would let a
+// message's actual delay silently grow past what the group was configured
+// for; callers clamp the new owner's computed wait down to this so handing a
+// message off doesn't relax the group's redelivery guarantee. Callers must
+// already hold qs's lock.
+func (qs *queueState) minInitialWait() time.Duration {
+	var min time.Duration
+	for _, sub := range qs.subs {
+		sub.RLock()
+		w := sub.redelivery.InitialWait
+		if w == 0 {
+			// No InitialWait configured for this member: it redelivers at
+			// its flat ackWaitInSecs, so that's the wait it actually
+			// contributes to the group's floor.
+			w = sub.ackWaitInSecs * time.Second
+		}
+		sub.RUnlock()
+		if w > 0 && (min == 0 || w < min) {
+			min = w
+		}
+	}
+	return min
+}
+
+// clampPendingWait lowers the nextDeliverAt sendMsgToSub just scheduled for
+// seq on sub down to now+groupMinWait if the receiving member's own
+// RedeliveryPolicy would otherwise have waited longer; see
+// queueState.minInitialWait. A no-op if groupMinWait is 0 (no member in the
+// group has InitialWait configured) or seq isn't pending. Caller must
+// already hold sub's lock.
+func clampPendingWait(sub *subState, seq uint64, groupMinWait time.Duration) {
+	if groupMinWait == 0 {
+		return
+	}
+	pm, ok := sub.acksPending[seq]
+	if !ok {
+		return
+	}
+	capped := time.Now().Add(groupMinWait).UnixNano()
+	if pm.nextDeliverAt > capped {
+		pm.nextDeliverAt = capped
+	}
+}
+
+// findLeastOutstandingSub is the original findBestQueueSub placeholder:
+// pick the push-eligible member with the fewest unacked (acksPending)
+// messages.
+// FIXME(dlc) - should just sort, or use insertion sort, etc.
+func (qs *queueState) findLeastOutstandingSub() (rsub *subState) {
+	for _, sub := range qs.pushMembers() {
 
 		if rsub == nil {
 			rsub = sub
@@ -600,19 +1916,93 @@ func findBestQueueSub(sl []*subState) (rsub *subState) {
 	return
 }
 
+// findRoundRobinSub cycles through the group's push-eligible members
+// starting at qs.rrCursor, picking the first one that isn't already at
+// maxInFlight. If every one is full it still returns one (advancing the
+// cursor) so the caller's existing sendMsgToSub stalled-handling takes
+// over, rather than returning nil.
+func (qs *queueState) findRoundRobinSub() *subState {
+	members := qs.pushMembers()
+	n := len(members)
+	if n == 0 {
+		return nil
+	}
+	if qs.rrCursor >= n {
+		qs.rrCursor = 0
+	}
+	for i := 0; i < n; i++ {
+		idx := (qs.rrCursor + i) % n
+		sub := members[idx]
+		sub.Lock()
+		notFull := len(sub.acksPending) < sub.maxInFlight
+		sub.Unlock()
+		if notFull {
+			qs.rrCursor = (idx + 1) % n
+			return sub
+		}
+	}
+	sub := members[qs.rrCursor]
+	qs.rrCursor = (qs.rrCursor + 1) % n
+	return sub
+}
+
+// findWeightedRandomSub picks randomly among push-eligible members not
+// already at maxInFlight, weighted by each member's weight
+// (subState.weight). Falls back to the first push-eligible member if every
+// one is full.
+func (qs *queueState) findWeightedRandomSub() *subState {
+	members := qs.pushMembers()
+	candidates := make([]*subState, 0, len(members))
+	weights := make([]int, 0, len(members))
+	total := 0
+
+	for _, sub := range members {
+		sub.Lock()
+		notFull := len(sub.acksPending) < sub.maxInFlight
+		w := sub.weight
+		sub.Unlock()
+
+		if !notFull {
+			continue
+		}
+		if w <= 0 {
+			w = 1
+		}
+		candidates = append(candidates, sub)
+		weights = append(weights, w)
+		total += w
+	}
+
+	if len(candidates) == 0 {
+		if len(members) == 0 {
+			return nil
+		}
+		return members[0]
+	}
+
+	r := rand.Intn(total)
+	for i, w := range weights {
+		if r < w {
+			return candidates[i]
+		}
+		r -= w
+	}
+	return candidates[len(candidates)-1]
+}
+
 // Send a message to the queue group
 // Assumes subStore lock is held
 // Assumes qs lock held for write
-func (s *stanServer) sendMsgToQueueGroup(qs *queueState, m *pb.MsgProto) bool {
+func (s *stanServer) sendMsgToQueueGroup(cs *channelStore, qs *queueState, m *pb.MsgProto) bool {
 	if qs == nil {
 		return false
 	}
-	sub := findBestQueueSub(qs.subs)
+	sub := qs.findBestQueueSub()
 	if sub == nil {
 		return false
 	}
 	sub.Lock()
-	didSend := s.sendMsgToSub(sub, m)
+	didSend := s.sendMsgToSub(sub, cs.subject, m, 1)
 	lastSent := sub.lastSent
 	sub.Unlock()
 	if !didSend {
@@ -645,17 +2035,17 @@ func (s *stanServer) processMsg(cs *channelStore) {
 }
 
 // Used for sorting by sequence
-type bySeq []*pb.MsgProto
+type bySeq []*pendingMsg
 
 func (a bySeq) Len() int           { return (len(a)) }
 func (a bySeq) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a bySeq) Less(i, j int) bool { return a[i].Sequence < a[j].Sequence }
+func (a bySeq) Less(i, j int) bool { return a[i].msg.Sequence < a[j].msg.Sequence }
 
-func makeSortedMsgs(msgs map[uint64]*pb.MsgProto) []*pb.MsgProto {
-	results := make([]*pb.MsgProto, 0, len(msgs))
-	for _, m := range msgs {
-		mCopy := *m // copy since we need to set redelivered flag.
-		results = append(results, &mCopy)
+func makeSortedMsgs(pending map[uint64]*pendingMsg) []*pendingMsg {
+	results := make([]*pendingMsg, 0, len(pending))
+	for _, pm := range pending {
+		mCopy := *pm.msg // copy since we need to set redelivered flag.
+		results = append(results, &pendingMsg{msg: &mCopy, deliveries: pm.deliveries, nextDeliverAt: pm.nextDeliverAt})
 	}
 	sort.Sort(bySeq(results))
 	return results
@@ -676,15 +2066,26 @@ func (s *stanServer) performAckExpirationRedelivery(sub *subState) {
 
 // Performs redelivery, takes a flag on whether to honor expiration.
 func (s *stanServer) performRedelivery(sub *subState, checkExpiration bool) {
+	// In cluster mode, only the node that currently owns this channel's
+	// Raft group drives redelivery. acksPending itself is not replicated:
+	// OpSetLastSent only records a durable's last-sent sequence in the
+	// cluster FSM (cluster.FSM.LastSent), which this server never reads
+	// back, so a newly-elected leader redelivers only from the acksPending
+	// it holds itself.
+	if cs := s.channels.Lookup(sub.subject); cs != nil && cs.cluster != nil && !cs.cluster.IsLeader() {
+		return
+	}
+
 	// Sort our messages outstanding from acksPending, grab some state and unlock.
 	sub.RLock()
-	expTime := int64(sub.ackWaitInSecs * time.Second)
 	sortedMsgs := makeSortedMsgs(sub.acksPending)
 	ackTimer := sub.ackTimer
 	inbox := sub.inbox
 	subject := sub.subject
 	qs := sub.qstate
 	clientID := sub.clientID
+	qgroup := sub.qgroup
+	rp := sub.redelivery
 	sub.RUnlock()
 
 	// If the client has some failed heartbeats, ignore this request.
@@ -702,9 +2103,10 @@ func (s *stanServer) performRedelivery(sub *subState, checkExpiration bool) {
 	now := time.Now().UnixNano()
 
 	// We will move through acksPending(sorted) and see what needs redelivery.
-	for _, m := range sortedMsgs {
+	for _, pm := range sortedMsgs {
+		m := pm.msg
 
-		remaining := m.Timestamp + expTime - now
+		remaining := pm.nextDeliverAt - now
 
 		if remaining > 0 && checkExpiration {
 
@@ -717,6 +2119,26 @@ func (s *stanServer) performRedelivery(sub *subState, checkExpiration bool) {
 			return
 		}
 
+		// MaxDeliver exhausted: drop the message instead of redelivering it
+		// again, optionally forwarding it to a dead-letter subject so the
+		// application can still act on it.
+		if rp.MaxDeliver > 0 && pm.deliveries >= rp.MaxDeliver {
+			Warnf("STAN: [Client:%s] Dropping message subject=%s seqno=%d after %d delivery attempts.",
+				clientID, m.Subject, m.Sequence, pm.deliveries)
+
+			sub.Lock()
+			sub.releasePending(m.Sequence)
+			if len(sub.acksPending) == 0 {
+				sub.clearAckTimer()
+			}
+			sub.Unlock()
+
+			if rp.DeadLetterSubject != "" {
+				s.storeDeadLetter(rp.DeadLetterSubject, m, pm.deliveries, qgroup, clientID)
+			}
+			continue
+		}
+
 		Tracef("STAN: [Client:%s] redelivery, sending seqno=%d.", clientID, m.Sequence)
 
 		// Flag as redelivered.
@@ -724,11 +2146,33 @@ func (s *stanServer) performRedelivery(sub *subState, checkExpiration bool) {
 
 		// Handle QueueSubscribers differently, since we will choose best subscriber
 		// to redeliver to, not necessarily the same one.
-		if qs != nil {
+		sub.RLock()
+		pullMode := sub.pullMode
+		sub.RUnlock()
+
+		if qs != nil && pullMode {
+			// A pull-mode queue member has no inbox listener for an async
+			// push redelivery (see subState.pullMode), so unlike a push
+			// member it isn't reassigned to qs.findBestQueueSub. Leave the
+			// message in its own acksPending with delivery bookkeeping
+			// advanced exactly like the non-queue path below; the next
+			// FetchRequest it sends picks it back up (see
+			// processFetchRequest/fetchForPullSub).
+			sub.Lock()
+			sub.ackTimer = nil
+			pm.deliveries++
+			backoff := rp.backOffFor(pm.deliveries)
+			if backoff == 0 {
+				backoff = sub.ackWaitInSecs * time.Second
+			}
+			pm.nextDeliverAt = time.Now().Add(backoff).UnixNano()
+			sub.acksPending[m.Sequence] = pm
+			sub.Unlock()
+		} else if qs != nil {
 			// Remove from current subs acksPending.
 			sub.Lock()
 
-			delete(sub.acksPending, m.Sequence)
+			sub.releasePending(m.Sequence)
 
 			// if there are no outstanding acks on this subscriber after
 			// removing our ack, clear the timer.
@@ -742,8 +2186,12 @@ func (s *stanServer) performRedelivery(sub *subState, checkExpiration bool) {
 			ss := cs.subs
 
 			var qsub *subState
+			var groupMinWait time.Duration
 			ss.RLock()
-			qsub = findBestQueueSub(qs.subs)
+			qs.Lock()
+			qsub = qs.findBestQueueSub()
+			groupMinWait = qs.minInitialWait()
+			qs.Unlock()
 			ss.RUnlock()
 
 			if qsub == nil {
@@ -753,10 +2201,21 @@ func (s *stanServer) performRedelivery(sub *subState, checkExpiration bool) {
 
 			qsub.Lock()
 			qsub.ackTimer = nil
-			s.sendMsgToSub(qsub, m)
+			s.sendMsgToSub(qsub, cs.subject, m, pm.deliveries+1)
+			clampPendingWait(qsub, m.Sequence, groupMinWait)
 			qsub.Unlock()
 		} else {
+			sub.Lock()
 			sub.ackTimer = nil
+			pm.deliveries++
+			backoff := rp.backOffFor(pm.deliveries)
+			if backoff == 0 {
+				backoff = sub.ackWaitInSecs * time.Second
+			}
+			pm.nextDeliverAt = time.Now().Add(backoff).UnixNano()
+			sub.acksPending[m.Sequence] = pm
+			sub.Unlock()
+
 			b, _ := m.Marshal()
 			if err := s.nc.Publish(inbox, b); err != nil {
 				// Break on error. FIXME(dlc) reset timer?
@@ -766,9 +2225,12 @@ func (s *stanServer) performRedelivery(sub *subState, checkExpiration bool) {
 	}
 }
 
-// Sends the message to the subscriber
+// Sends the message to the subscriber. deliveries is the delivery attempt
+// number being made (1 for a first-time send, pm.deliveries+1 when called
+// from performRedelivery's queue-group path) and is used to pick the next
+// RedeliveryPolicy backoff.
 // Sub lock should be held before calling.
-func (s *stanServer) sendMsgToSub(sub *subState, m *pb.MsgProto) bool {
+func (s *stanServer) sendMsgToSub(sub *subState, channel string, m *pb.MsgProto, deliveries int) bool {
 	if sub == nil || m == nil {
 		return false
 	}
@@ -784,150 +2246,784 @@ func (s *stanServer) sendMsgToSub(sub *subState, m *pb.MsgProto) bool {
 		return false
 	}
 
-	oldLast := sub.lastSent
-	sub.lastSent = m.Sequence
+	// Don't send if it would push outstanding bytes over MaxPendingBytes, or
+	// if the RateLimitBps token bucket doesn't have enough tokens yet.
+	size := m.Size()
+	if sub.flowControl.MaxPendingBytes > 0 && sub.pendingBytes+uint64(size) > sub.flowControl.MaxPendingBytes {
+		sub.stalled = true
+		Debugf("STAN: [Client:%s] Stalled (pending bytes) msgseq %s:%d to %s.",
+			sub.clientID, m.Subject, m.Sequence, sub.inbox)
+		return false
+	}
+	if !sub.allowByRate(size) {
+		sub.stalled = true
+		Debugf("STAN: [Client:%s] Stalled (rate limit) msgseq %s:%d to %s.",
+			sub.clientID, m.Subject, m.Sequence, sub.inbox)
+		// Unlike the maxInFlight/MaxPendingBytes stalls above, nothing
+		// about this one changes when an ack comes in - it only clears by
+		// tokens accruing over time - so an ack-driven unstall (see
+		// processAck) would never retry it if the subscription's consumer
+		// is otherwise keeping up. Arm a timer for when enough tokens will
+		// have accrued to cover this message and retry delivery then.
+		s.armRateTimer(sub, channel, size)
+		return false
+	}
+
+	// PendingLimits is a second, independent cap on the same acksPending
+	// backlog flowControl paces: where flowControl only ever stalls and
+	// waits for acks to free up room, a SlowConsumerDrop policy instead
+	// skips the message so a slow consumer can't wedge the subscription
+	// indefinitely.
+	pl := sub.pendingLimits
+	if (pl.MsgLimit > 0 && len(sub.acksPending) >= pl.MsgLimit) ||
+		(pl.BytesLimit > 0 && sub.pendingBytes+uint64(size) > pl.BytesLimit) {
+		if pl.Policy == SlowConsumerDrop {
+			sub.dropped++
+			sub.setLastSentFor(channel, m.Sequence)
+			Debugf("STAN: [Client:%s] Dropped (pending limits) msgseq %s:%d to %s.",
+				sub.clientID, m.Subject, m.Sequence, sub.inbox)
+			return true
+		}
+		sub.stalled = true
+		Debugf("STAN: [Client:%s] Stalled (pending limits) msgseq %s:%d to %s.",
+			sub.clientID, m.Subject, m.Sequence, sub.inbox)
+		return false
+	}
+
+	oldLast := sub.lastSentFor(channel)
+	sub.setLastSentFor(channel, m.Sequence)
 	b, _ := m.Marshal()
 	if err := s.nc.Publish(sub.inbox, b); err != nil {
-		sub.lastSent = oldLast
+		sub.setLastSentFor(channel, oldLast)
 		Errorf("STAN: [Client:%s] Failed Sending msgseq %s:%d to %s (%s).",
 			sub.clientID, m.Subject, m.Sequence, sub.inbox, err)
 		return false
 	}
-	// Store in ackPending.
-	sub.acksPending[m.Sequence] = m
 
-	// Setup the ackTimer as needed.
-	if sub.ackTimer == nil {
-		sub.ackTimer = time.AfterFunc(sub.ackWaitInSecs*time.Second, func() {
-			s.performAckExpirationRedelivery(sub)
-		})
+	backoff := sub.redelivery.backOffFor(deliveries)
+	if backoff == 0 {
+		backoff = sub.ackWaitInSecs * time.Second
+	}
+	// Store in ackPending.
+	sub.acksPending[m.Sequence] = &pendingMsg{
+		msg:           m,
+		deliveries:    deliveries,
+		nextDeliverAt: time.Now().Add(backoff).UnixNano(),
+	}
+	sub.pendingBytes += uint64(size)
+
+	// Setup the ackTimer as needed, firing at this message's own
+	// backoff-derived deadline rather than a flat ackWaitInSecs.
+	if sub.ackTimer == nil {
+		sub.ackTimer = time.AfterFunc(backoff, func() {
+			s.performAckExpirationRedelivery(sub)
+		})
+	}
+
+	// In cluster mode, replicate a durable's new lastSent position into the
+	// channel's Raft FSM (see cluster.FSM.LastSent). This server never reads
+	// that position back, so a newly-elected leader does not resume from it.
+	if sub.durableName != "" {
+		if cs := s.channels.Lookup(channel); cs != nil && cs.cluster != nil {
+			cmd := cluster.Command{Op: cluster.OpSetLastSent, DurableKey: sub.durableKey(), LastSent: m.Sequence}
+			if _, err := cs.cluster.Propose(cmd); err != nil {
+				Errorf("STAN: failed to replicate durable position for %q: %v", sub.durableKey(), err)
+			}
+		}
+	}
+
+	return true
+}
+
+// assignAndStore will assign a sequence ID and then store the message,
+// returning an error if the message was not actually stored anywhere - the
+// caller must not ack the publisher in that case.
+func (s *stanServer) assignAndStore(pm *pb.PubMsg) (*channelStore, error) {
+	cs := s.channels.LookupOrCreate(pm.Subject)
+
+	if cs.cluster != nil {
+		// Cluster mode: replicate the store through Raft instead of writing
+		// to cs.msgs directly, so sequence assignment and the message log
+		// stay consistent across a leader change. A follower lands here
+		// too (every node runs processClientPublish); Propose fails with
+		// raft.ErrNotLeader in that case - see the cluster package doc
+		// comment for why that isn't forwarded to the leader automatically
+		// yet - and the caller rejects the publish instead of storing it
+		// only locally.
+		cmd := cluster.Command{Op: cluster.OpStore, Subject: pm.Subject, Reply: pm.Reply, Data: pm.Data}
+		if _, err := cs.cluster.Propose(cmd); err != nil {
+			return nil, ErrPublishNotReplicated
+		}
+		return cs, nil
+	}
+
+	// FIXME(dlc) - check for errors.
+	cs.msgs.Store(pm.Subject, pm.Reply, pm.Data)
+	return cs, nil
+}
+
+// ackPublisher sends the ack for a message.
+func (s *stanServer) ackPublisher(pm *pb.PubMsg, reply string) {
+	msgAck := &pb.PubAck{Guid: pm.Guid}
+	var buf [32]byte
+	b := buf[:]
+	n, _ := msgAck.MarshalTo(b)
+	Tracef("STAN: [Client:%s] Acking Publisher subj=%s guid=%s", pm.ClientID, pm.Subject, pm.Guid)
+	s.nc.Publish(reply, b[:n])
+}
+
+// Delete a sub from a given list.
+func (sub *subState) deleteFromList(sl []*subState) []*subState {
+	for i := 0; i < len(sl); i++ {
+		if sl[i] == sub {
+			sl[i] = sl[len(sl)-1]
+			sl[len(sl)-1] = nil
+			sl = sl[:len(sl)-1]
+			return shrinkSubListIfNeeded(sl)
+		}
+	}
+	return sl
+}
+
+// Checks if we need to do a resize. This is for very large growth then
+// subsequent return to a more normal size.
+func shrinkSubListIfNeeded(sl []*subState) []*subState {
+	lsl := len(sl)
+	csl := cap(sl)
+	// Don't bother if list not too big
+	if csl <= 8 {
+		return sl
+	}
+	pFree := float32(csl-lsl) / float32(csl)
+	if pFree > 0.50 {
+		return append([]*subState(nil), sl...)
+	}
+	return sl
+}
+
+// removeAllNonDurableSubscribers will remove all non-durable subscribers for the client.
+func (s *stanServer) removeAllNonDurableSubscribers(clientID string) {
+	client := s.clients.Lookup(clientID)
+	if client == nil {
+		return
+	}
+	client.RLock()
+	defer client.RUnlock()
+
+	for _, sub := range client.subs {
+		sub.Lock()
+		sub.clearAckTimer()
+		subject := sub.subject
+		isDurable := sub.isDurable()
+		sub.clientID = ""
+		sub.Unlock()
+
+		// Skip removal if durable.
+		if isDurable {
+			continue
+		}
+		cs := s.channels.Lookup(subject)
+		if cs == nil {
+			continue
+		}
+		cs.subs.Remove(sub)
+		s.transferExclusiveQueuePending(cs, sub)
+	}
+}
+
+// processUnSubscribeRequest will process a unsubscribe request.
+func (s *stanServer) processUnSubscribeRequest(m *nats.Msg) {
+	req := &pb.UnsubscribeRequest{}
+	err := req.Unmarshal(m.Data)
+	if err != nil {
+		Errorf("STAN: Invalid unsub request from %s.", m.Subject)
+		s.sendSubscriptionResponseErr(m.Reply, err)
+		return
+	}
+
+	cs := s.channels.Lookup(req.Subject)
+	if cs == nil {
+		Errorf("STAN: [Client:%s] unsub request missing subject %s.",
+			req.ClientID, req.Subject)
+		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSub)
+		return
+	}
+	sub := cs.subs.LookupByAckInbox(req.Inbox)
+	if sub == nil {
+		Errorf("STAN: [Client:%s] unsub request for missing inbox %s.",
+			req.ClientID, req.Inbox)
+		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSub)
+		return
+	}
+	// Remove the subscription.
+	cs.subs.Remove(sub)
+	s.transferExclusiveQueuePending(cs, sub)
+
+	// Remove from Client
+	if client := s.clients.Lookup(req.ClientID); client != nil {
+		Debugf("STAN: [Client:%s] Unsubscribing subject=%s.",
+			req.ClientID, sub.subject)
+		client.RemoveSub(sub)
+	}
+
+	// Create a non-error response
+	resp := &pb.SubscriptionResponse{AckInbox: req.Inbox}
+	b, _ := resp.Marshal()
+	s.nc.Publish(m.Reply, b)
+}
+
+// processSubCloseRequest will process a subscription close (suspend) request.
+// Unlike processUnSubscribeRequest, this detaches the client-side interest
+// but, for durables, retains the subscription's ackSeqPending state on the
+// server so that a later re-subscribe with the same DurableName resumes
+// where it left off.
+func (s *stanServer) processSubCloseRequest(m *nats.Msg) {
+	req := &pb.UnsubscribeRequest{}
+	err := req.Unmarshal(m.Data)
+	if err != nil {
+		Errorf("STAN: Invalid sub close request from %s.", m.Subject)
+		s.sendSubscriptionResponseErr(m.Reply, err)
+		return
+	}
+
+	cs := s.channels.Lookup(req.Subject)
+	if cs == nil {
+		Errorf("STAN: [Client:%s] sub close request missing subject %s.",
+			req.ClientID, req.Subject)
+		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSub)
+		return
+	}
+	sub := cs.subs.LookupByAckInbox(req.Inbox)
+	if sub == nil {
+		Errorf("STAN: [Client:%s] sub close request for missing inbox %s.",
+			req.ClientID, req.Inbox)
+		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSub)
+		return
+	}
+
+	// Suspend the subscription: stop redelivery and detach from the
+	// client, but keep it (and its acksPending state) registered so a
+	// durable can resume later.
+	cs.subs.Suspend(sub)
+
+	// Remove from Client
+	if client := s.clients.Lookup(req.ClientID); client != nil {
+		Debugf("STAN: [Client:%s] Closing subscription subject=%s.",
+			req.ClientID, sub.subject)
+		client.RemoveSub(sub)
+	}
+
+	resp := &pb.SubscriptionResponse{AckInbox: req.Inbox}
+	b, _ := resp.Marshal()
+	s.nc.Publish(m.Reply, b)
+}
+
+// processPingRequest answers a client-to-server ping. The client tracks
+// consecutive unanswered pings itself; all the server needs to do is prove
+// it is still alive and reachable.
+func (s *stanServer) processPingRequest(m *nats.Msg) {
+	resp := &pb.PingResponse{}
+	b, _ := resp.Marshal()
+	s.nc.Publish(m.Reply, b)
+}
+
+func (s *stanServer) sendSubscriptionResponseErr(reply string, err error) {
+	resp := &pb.SubscriptionResponse{Error: err.Error()}
+	b, _ := resp.Marshal()
+	s.nc.Publish(reply, b)
+}
+
+// SubscriptionStatusRequest asks for the current Pending/Dropped counters of
+// one subscription, identified the same way a close/unsub request is
+// (Subject plus the ack inbox handed back in the original
+// pb.SubscriptionResponse).
+//
+// This and SubscriptionStatusResponse are plain Go structs marshaled as
+// JSON, not gogoproto messages like the rest of the client/server protocol:
+// pb.SubscriptionRequest/Response are generated from a vendored .proto this
+// tree doesn't own, so neither can gain new fields nor can pb gain an
+// entirely new message pair without regenerating that vendored code. JSON
+// over a dedicated request/reply subject (stanServer.subStatusRequests)
+// gets the same request/response shape without needing to touch pb.
+type SubscriptionStatusRequest struct {
+	Subject string
+	Inbox   string
+}
+
+// SubscriptionStatusResponse answers a SubscriptionStatusRequest. Error is
+// set (and the other fields left zero) if the subscription could not be
+// found.
+type SubscriptionStatusResponse struct {
+	PendingMsgs  int
+	PendingBytes uint64
+	Dropped      uint64
+	Error        string `json:",omitempty"`
+}
+
+// sendSubscriptionStatusErr replies to a SubscriptionStatusRequest with an
+// error, mirroring sendSubscriptionResponseErr.
+func (s *stanServer) sendSubscriptionStatusErr(reply string, err error) {
+	resp := &SubscriptionStatusResponse{Error: err.Error()}
+	b, _ := json.Marshal(resp)
+	s.nc.Publish(reply, b)
+}
+
+// processSubscriptionStatusRequest answers a SubscriptionStatusRequest with
+// the subscription's current PendingLimits-relevant counters.
+func (s *stanServer) processSubscriptionStatusRequest(m *nats.Msg) {
+	req := &SubscriptionStatusRequest{}
+	if err := json.Unmarshal(m.Data, req); err != nil {
+		Errorf("STAN: Invalid sub status request from %s.", m.Subject)
+		s.sendSubscriptionStatusErr(m.Reply, err)
+		return
+	}
+
+	cs := s.channels.Lookup(req.Subject)
+	if cs == nil {
+		s.sendSubscriptionStatusErr(m.Reply, ErrInvalidSub)
+		return
+	}
+	sub := cs.subs.LookupByAckInbox(req.Inbox)
+	if sub == nil {
+		s.sendSubscriptionStatusErr(m.Reply, ErrInvalidSub)
+		return
+	}
+
+	sub.RLock()
+	resp := &SubscriptionStatusResponse{
+		PendingMsgs:  len(sub.acksPending),
+		PendingBytes: sub.pendingBytes,
+		Dropped:      sub.dropped,
+	}
+	sub.RUnlock()
+
+	b, _ := json.Marshal(resp)
+	s.nc.Publish(m.Reply, b)
+}
+
+// PullModeRequest converts an existing queue-group subscription, identified
+// the same way a SubscriptionStatusRequest is (Subject plus the ack inbox
+// handed back in the original pb.SubscriptionResponse), into a pull-mode
+// member: one that receives no further asynchronous push deliveries and
+// must retrieve messages by sending FetchRequests instead (see
+// subState.pullMode). It's meant to be sent once, immediately after the
+// initial pb.SubscriptionRequest completes; there is a narrow window
+// between the two where a message could still be pushed to the
+// subscription's inbox before the conversion lands.
+//
+// Plain JSON over stanServer.pullConvertRequests rather than a new field on
+// pb.SubscriptionRequest, for the same vendored-pb reason
+// SubscriptionStatusRequest is - see its doc comment.
+type PullModeRequest struct {
+	Subject string
+	Inbox   string
+}
+
+// PullModeResponse answers a PullModeRequest. Error is set if Inbox didn't
+// name a queue-group member.
+type PullModeResponse struct {
+	Error string `json:",omitempty"`
+}
+
+// sendPullModeErr replies to a PullModeRequest with an error, mirroring
+// sendSubscriptionStatusErr.
+func (s *stanServer) sendPullModeErr(reply string, err error) {
+	resp := &PullModeResponse{Error: err.Error()}
+	b, _ := json.Marshal(resp)
+	s.nc.Publish(reply, b)
+}
+
+// processPullModeRequest marks the named subscription pull-mode; see
+// PullModeRequest.
+func (s *stanServer) processPullModeRequest(m *nats.Msg) {
+	req := &PullModeRequest{}
+	if err := json.Unmarshal(m.Data, req); err != nil {
+		Errorf("STAN: Invalid pull mode request from %s.", m.Subject)
+		s.sendPullModeErr(m.Reply, err)
+		return
+	}
+
+	cs := s.channels.Lookup(req.Subject)
+	if cs == nil {
+		s.sendPullModeErr(m.Reply, ErrInvalidSub)
+		return
+	}
+	sub := cs.subs.LookupByAckInbox(req.Inbox)
+	if sub == nil || !sub.isQueueSubscriber() {
+		s.sendPullModeErr(m.Reply, ErrInvalidSub)
+		return
+	}
+
+	sub.Lock()
+	sub.pullMode = true
+	sub.Unlock()
+
+	b, _ := json.Marshal(&PullModeResponse{})
+	s.nc.Publish(m.Reply, b)
+}
+
+// FetchRequest asks for up to Batch not-yet-delivered messages from a
+// pull-mode queue subscription (see PullModeRequest), identified the same
+// way a SubscriptionStatusRequest is.
+//
+// Plain JSON over stanServer.fetchRequests rather than a gogoproto message,
+// for the same vendored-pb reason SubscriptionStatusRequest is.
+type FetchRequest struct {
+	Subject string
+	Inbox   string
+	// Batch is how many messages to return at most. Treated as 1 if <= 0.
+	Batch int
+	// MaxWait bounds how long the server blocks waiting for at least one
+	// message to become available before replying empty. Ignored if NoWait
+	// is set.
+	MaxWait time.Duration
+	// NoWait, if set, makes Fetch reply immediately with whatever is
+	// already available (possibly nothing) instead of waiting.
+	NoWait bool
+}
+
+// FetchResponse answers a FetchRequest. Error is set (and Msgs empty) if
+// Inbox doesn't name a pull-mode subscription; an empty Msgs with no Error
+// just means nothing was available within MaxWait (or at all, for NoWait).
+type FetchResponse struct {
+	Msgs  []*pb.MsgProto
+	Error string `json:",omitempty"`
+}
+
+// sendFetchErr replies to a FetchRequest with an error, mirroring
+// sendSubscriptionStatusErr.
+func (s *stanServer) sendFetchErr(reply string, err error) {
+	resp := &FetchResponse{Error: err.Error()}
+	b, _ := json.Marshal(resp)
+	s.nc.Publish(reply, b)
+}
+
+// processFetchRequest answers a FetchRequest for a pull-mode queue member.
+// It gathers up to Batch messages via fetchForPullSub; if none are
+// available yet and the caller didn't ask for NoWait, it blocks (via
+// queueState.addWaiter) until either one arrives or MaxWait elapses, then
+// replies with whatever ended up available - possibly still nothing, which
+// is not itself an error.
+func (s *stanServer) processFetchRequest(m *nats.Msg) {
+	req := &FetchRequest{}
+	if err := json.Unmarshal(m.Data, req); err != nil {
+		Errorf("STAN: Invalid fetch request from %s.", m.Subject)
+		s.sendFetchErr(m.Reply, err)
+		return
+	}
+
+	cs := s.channels.Lookup(req.Subject)
+	if cs == nil {
+		s.sendFetchErr(m.Reply, ErrInvalidSub)
+		return
+	}
+	sub := cs.subs.LookupByAckInbox(req.Inbox)
+	if sub == nil {
+		s.sendFetchErr(m.Reply, ErrInvalidSub)
+		return
+	}
+	sub.RLock()
+	qs := sub.qstate
+	pullMode := sub.pullMode
+	sub.RUnlock()
+	if qs == nil || !pullMode {
+		s.sendFetchErr(m.Reply, errors.New("stan: subscription is not a pull queue member"))
+		return
+	}
+
+	batch := req.Batch
+	if batch <= 0 {
+		batch = 1
+	}
+
+	msgs := s.fetchForPullSub(cs, qs, sub, batch)
+	if len(msgs) == 0 && !req.NoWait && req.MaxWait > 0 {
+		ch, remove := qs.addWaiter()
+		select {
+		case <-ch:
+		case <-time.After(req.MaxWait):
+		}
+		remove()
+		msgs = s.fetchForPullSub(cs, qs, sub, batch)
+	}
+
+	b, _ := json.Marshal(&FetchResponse{Msgs: msgs})
+	s.nc.Publish(m.Reply, b)
+}
+
+// fetchForPullSub gathers up to batch messages for a pull-mode queue member
+// sub: first any of its own already-expired acksPending entries (advanced
+// and marked Redelivered exactly as performRedelivery's pullMode branch
+// does - this is in fact the same bookkeeping, just read back out here
+// instead of waiting for the ackTimer to fire), then fresh messages from
+// the queue group's shared qs.lastSent cursor, gated by sub.maxInFlight the
+// same way sendMsgToSub gates a push delivery.
+//
+// Unlike sendMsgToSub, this does not apply flowControl or pendingLimits:
+// those exist to pace a server that's proactively pushing faster than a
+// consumer can keep up, which doesn't apply to pull delivery - the consumer
+// is already pacing itself by choosing when and how much to Fetch. It also
+// doesn't replicate a durable's position through cluster.Cluster the way
+// sendMsgToSub does, so a durable pull-mode member's position isn't
+// failover-safe yet; a real fix would thread a cluster command through
+// here too, left as a follow-up.
+func (s *stanServer) fetchForPullSub(cs *channelStore, qs *queueState, sub *subState, batch int) []*pb.MsgProto {
+	var msgs []*pb.MsgProto
+
+	sub.Lock()
+	now := time.Now().UnixNano()
+	rp := sub.redelivery
+	for _, pm := range makeSortedMsgs(sub.acksPending) {
+		if len(msgs) >= batch {
+			break
+		}
+		if pm.nextDeliverAt > now {
+			break
+		}
+		// makeSortedMsgs hands back copies, so advance and write each one
+		// back into acksPending here exactly as performRedelivery's
+		// non-reassigning branches do, rather than mutating a throwaway.
+		pm.deliveries++
+		backoff := rp.backOffFor(pm.deliveries)
+		if backoff == 0 {
+			backoff = sub.ackWaitInSecs * time.Second
+		}
+		pm.nextDeliverAt = time.Now().Add(backoff).UnixNano()
+		pm.msg.Redelivered = true
+		sub.acksPending[pm.msg.Sequence] = pm
+		msgs = append(msgs, pm.msg)
+	}
+	sub.Unlock()
+
+	if len(msgs) >= batch {
+		return msgs
 	}
 
-	return true
-}
+	qs.Lock()
+	defer qs.Unlock()
 
-// assignAndStore will assign a sequence ID and then store the message.
-func (s *stanServer) assignAndStore(pm *pb.PubMsg) *channelStore {
-	cs := s.channels.LookupOrCreate(pm.Subject)
-	// FIXME(dlc) - check for errors.
-	cs.msgs.Store(pm.Subject, pm.Reply, pm.Data)
-	return cs
-}
+	for nextSeq := qs.lastSent + 1; len(msgs) < batch; nextSeq++ {
+		nextMsg := cs.msgs.Lookup(nextSeq)
+		if nextMsg == nil {
+			break
+		}
 
-// ackPublisher sends the ack for a message.
-func (s *stanServer) ackPublisher(pm *pb.PubMsg, reply string) {
-	msgAck := &pb.PubAck{Guid: pm.Guid}
-	var buf [32]byte
-	b := buf[:]
-	n, _ := msgAck.MarshalTo(b)
-	Tracef("STAN: [Client:%s] Acking Publisher subj=%s guid=%s", pm.ClientID, pm.Subject, pm.Guid)
-	s.nc.Publish(reply, b[:n])
-}
+		sub.Lock()
+		full := len(sub.acksPending) >= sub.maxInFlight
+		if !full {
+			backoff := sub.redelivery.backOffFor(1)
+			if backoff == 0 {
+				backoff = sub.ackWaitInSecs * time.Second
+			}
+			sub.acksPending[nextMsg.Sequence] = &pendingMsg{
+				msg:           nextMsg,
+				deliveries:    1,
+				nextDeliverAt: time.Now().Add(backoff).UnixNano(),
+			}
+			sub.pendingBytes += uint64(nextMsg.Size())
+			sub.setLastSentFor(cs.subject, nextMsg.Sequence)
+			if sub.ackTimer == nil {
+				sub.ackTimer = time.AfterFunc(sub.ackWaitInSecs*time.Second, func() {
+					s.performAckExpirationRedelivery(sub)
+				})
+			}
+		}
+		sub.Unlock()
 
-// Delete a sub from a given list.
-func (sub *subState) deleteFromList(sl []*subState) []*subState {
-	for i := 0; i < len(sl); i++ {
-		if sl[i] == sub {
-			sl[i] = sl[len(sl)-1]
-			sl[len(sl)-1] = nil
-			sl = sl[:len(sl)-1]
-			return shrinkSubListIfNeeded(sl)
+		if full {
+			break
 		}
-	}
-	return sl
+		if nextMsg.Sequence > qs.lastSent {
+			qs.lastSent = nextMsg.Sequence
+		}
+		msgs = append(msgs, nextMsg)
+	}
+	return msgs
+}
+
+// ExclusiveQueueRequest marks an existing queue group single-active (see
+// stan.ExclusiveQueue): only its one active member - the surviving member
+// registered earliest - ever receives a message; see queueState.exclusive
+// and queueState.pushMembers. Unlike PullModeRequest/FetchRequest, this
+// targets the group as a whole rather than one member, so it's identified by
+// Subject+QGroup rather than an ackInbox - whichever member(s) subscribe
+// under that group benefit, including ones that join after this request.
+//
+// Plain JSON over stanServer.exclusiveQueueRequests, for the same
+// vendored-pb reason SubscriptionStatusRequest is; see
+// DefaultExclusiveQueuePrefix for why this one subject, unlike
+// pullConvertRequests/fetchRequests, is derived deterministically rather
+// than from a per-server nuid.
+type ExclusiveQueueRequest struct {
+	Subject string
+	QGroup  string
+}
+
+// ExclusiveQueueResponse answers an ExclusiveQueueRequest. Error is set if
+// Subject+QGroup doesn't name a queue group that has had at least one member
+// subscribe yet.
+type ExclusiveQueueResponse struct {
+	Error string `json:",omitempty"`
+}
+
+// sendExclusiveQueueErr replies to an ExclusiveQueueRequest with an error,
+// mirroring sendPullModeErr.
+func (s *stanServer) sendExclusiveQueueErr(reply string, err error) {
+	resp := &ExclusiveQueueResponse{Error: err.Error()}
+	b, _ := json.Marshal(resp)
+	s.nc.Publish(reply, b)
 }
 
-// Checks if we need to do a resize. This is for very large growth then
-// subsequent return to a more normal size.
-func shrinkSubListIfNeeded(sl []*subState) []*subState {
-	lsl := len(sl)
-	csl := cap(sl)
-	// Don't bother if list not too big
-	if csl <= 8 {
-		return sl
+// processExclusiveQueueRequest marks the named queue group exclusive; see
+// ExclusiveQueueRequest.
+func (s *stanServer) processExclusiveQueueRequest(m *nats.Msg) {
+	req := &ExclusiveQueueRequest{}
+	if err := json.Unmarshal(m.Data, req); err != nil {
+		Errorf("STAN: Invalid exclusive queue request from %s.", m.Subject)
+		s.sendExclusiveQueueErr(m.Reply, err)
+		return
 	}
-	pFree := float32(csl-lsl) / float32(csl)
-	if pFree > 0.50 {
-		return append([]*subState(nil), sl...)
+
+	cs := s.channels.Lookup(req.Subject)
+	if cs == nil {
+		s.sendExclusiveQueueErr(m.Reply, ErrInvalidSub)
+		return
 	}
-	return sl
+	qs := cs.subs.LookupQueueState(req.QGroup)
+	if qs == nil {
+		s.sendExclusiveQueueErr(m.Reply, ErrInvalidSub)
+		return
+	}
+
+	qs.Lock()
+	qs.exclusive = true
+	qs.Unlock()
+
+	b, _ := json.Marshal(&ExclusiveQueueResponse{})
+	s.nc.Publish(m.Reply, b)
 }
 
-// removeAllNonDurableSubscribers will remove all non-durable subscribers for the client.
-func (s *stanServer) removeAllNonDurableSubscribers(clientID string) {
-	client := s.clients.Lookup(clientID)
-	if client == nil {
+// transferExclusiveQueuePending hands sub's outstanding acksPending to its
+// exclusive queue group's new active member once sub has been removed (see
+// subStore.Remove) from an exclusive group (queueState.exclusive) - i.e. the
+// active member just disconnected or unsubscribed - redelivering each
+// pending message exactly the way performRedelivery's own queue-reassignment
+// branch does. A no-op if sub wasn't in a queue group, the group isn't
+// exclusive, or nothing was pending.
+//
+// Known limitation: like fetchForPullSub, this doesn't replicate the
+// transfer through cluster.Cluster, so it isn't failover-safe yet.
+func (s *stanServer) transferExclusiveQueuePending(cs *channelStore, sub *subState) {
+	sub.Lock()
+	qs := sub.qstate
+	pending := sub.acksPending
+	sub.acksPending = make(map[uint64]*pendingMsg)
+	sub.Unlock()
+
+	if qs == nil || len(pending) == 0 {
 		return
 	}
-	client.RLock()
-	defer client.RUnlock()
 
-	for _, sub := range client.subs {
+	qs.Lock()
+	exclusive := qs.exclusive
+	qs.Unlock()
+	if !exclusive {
+		// Not exclusive: nothing special to do here, give the messages
+		// back so ordinary AckWait-expiration redelivery
+		// (performRedelivery) reassigns them through qs.findBestQueueSub
+		// like it always has for a non-exclusive group.
 		sub.Lock()
-		sub.clearAckTimer()
-		subject := sub.subject
-		isDurable := sub.isDurable()
-		sub.clientID = ""
+		sub.acksPending = pending
 		sub.Unlock()
+		return
+	}
 
-		// Skip removal if durable.
-		if isDurable {
-			continue
-		}
-		cs := s.channels.Lookup(subject)
-		if cs == nil {
-			continue
-		}
-		cs.subs.Remove(sub)
+	ss := cs.subs
+	ss.RLock()
+	qs.Lock()
+	active := qs.findBestQueueSub()
+	groupMinWait := qs.minInitialWait()
+	qs.Unlock()
+	ss.RUnlock()
+
+	if active == nil {
+		Warnf("STAN: [Channel:%s] No member left to receive %d transferred message(s) for exclusive queue group.",
+			cs.subject, len(pending))
+		return
 	}
+
+	active.Lock()
+	active.ackTimer = nil
+	for _, pm := range makeSortedMsgs(pending) {
+		s.sendMsgToSub(active, cs.subject, pm.msg, pm.deliveries+1)
+		clampPendingWait(active, pm.msg.Sequence, groupMinWait)
+	}
+	active.Unlock()
 }
 
-// processUnSubscribeRequest will process a unsubscribe request.
-func (s *stanServer) processUnSubscribeRequest(m *nats.Msg) {
-	req := &pb.UnsubscribeRequest{}
-	err := req.Unmarshal(m.Data)
-	if err != nil {
-		Errorf("STAN: Invalid unsub request from %s.", m.Subject)
-		s.sendSubscriptionResponseErr(m.Reply, err)
+// QueueGroupRequest asks whether QGroup already has a member registered on
+// Subject, for stan.BindQueueGroup: unlike a plain QueueSubscribe, which
+// creates the group as a side effect of its first member joining,
+// BindQueueGroup wants to attach to a group some other process already
+// created rather than silently starting a new one under that name.
+//
+// Plain JSON over stanServer.queueGroupRequests, for the same vendored-pb
+// reason SubscriptionStatusRequest is; deterministic rather than
+// nuid-derived for the same reason ExclusiveQueueRequest's subject is - see
+// DefaultQueueGroupPrefix.
+type QueueGroupRequest struct {
+	Subject  string
+	QGroup   string
+	ClientID string
+}
+
+// QueueGroupResponse answers a QueueGroupRequest. Error is set if Subject
+// has no member registered under QGroup yet.
+type QueueGroupResponse struct {
+	Error string `json:",omitempty"`
+}
+
+// sendQueueGroupErr replies to a QueueGroupRequest with an error, mirroring
+// sendExclusiveQueueErr.
+func (s *stanServer) sendQueueGroupErr(reply string, err error) {
+	resp := &QueueGroupResponse{Error: err.Error()}
+	b, _ := json.Marshal(resp)
+	s.nc.Publish(reply, b)
+}
+
+// processQueueGroupRequest answers a QueueGroupRequest; see
+// stan.BindQueueGroup. The existence check and the pending-bind marker
+// Store later consumes are set atomically under the channel's subStore
+// lock (CheckAndMarkPendingBind), so a group that drains its last member
+// between this reply and the client's follow-up subscribe is caught there
+// instead of silently letting that subscribe start a brand new group. That
+// guarantee only holds because subStore.Remove deletes a group's qsubs
+// entry once its last member leaves (see Remove) - otherwise "exists"
+// would stay true forever for any name ever used, and a bind long after
+// every member disconnected would silently join a fresh single-member
+// group under the old name instead of failing.
+func (s *stanServer) processQueueGroupRequest(m *nats.Msg) {
+	req := &QueueGroupRequest{}
+	if err := json.Unmarshal(m.Data, req); err != nil {
+		Errorf("STAN: Invalid queue group request from %s.", m.Subject)
+		s.sendQueueGroupErr(m.Reply, err)
 		return
 	}
 
 	cs := s.channels.Lookup(req.Subject)
 	if cs == nil {
-		Errorf("STAN: [Client:%s] unsub request missing subject %s.",
-			req.ClientID, req.Subject)
-		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSub)
+		s.sendQueueGroupErr(m.Reply, ErrInvalidSub)
 		return
 	}
-	sub := cs.subs.LookupByAckInbox(req.Inbox)
-	if sub == nil {
-		Errorf("STAN: [Client:%s] unsub request for missing inbox %s.",
-			req.ClientID, req.Inbox)
-		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSub)
+	if err := cs.subs.CheckAndMarkPendingBind(req.ClientID, req.QGroup); err != nil {
+		s.sendQueueGroupErr(m.Reply, err)
 		return
 	}
-	// Remove the subscription.
-	cs.subs.Remove(sub)
-
-	// Remove from Client
-	if client := s.clients.Lookup(req.ClientID); client != nil {
-		Debugf("STAN: [Client:%s] Unsubscribing subject=%s.",
-			req.ClientID, sub.subject)
-		client.RemoveSub(sub)
-	}
 
-	// Create a non-error response
-	resp := &pb.SubscriptionResponse{AckInbox: req.Inbox}
-	b, _ := resp.Marshal()
+	b, _ := json.Marshal(&QueueGroupResponse{})
 	s.nc.Publish(m.Reply, b)
 }
 
-func (s *stanServer) sendSubscriptionResponseErr(reply string, err error) {
-	resp := &pb.SubscriptionResponse{Error: err.Error()}
-	b, _ := resp.Marshal()
-	s.nc.Publish(reply, b)
-}
-
 // Check for valid subjects
 func isValidSubject(subject string) bool {
 	tokens := strings.Split(subject, ".")
@@ -942,6 +3038,73 @@ func isValidSubject(subject string) bool {
 	return true
 }
 
+// parseFilterSubjects splits a (possibly multi-subject) subscription
+// request's Subject field on commas. The wire protocol (pb.SubscriptionRequest)
+// still has a single Subject string, so a comma-separated list is the
+// compatibility shim for what would otherwise be a repeated
+// FilterSubjects field; a request with no comma behaves exactly as before.
+func parseFilterSubjects(subject string) []string {
+	parts := strings.Split(subject, ",")
+	filters := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			filters = append(filters, p)
+		}
+	}
+	return filters
+}
+
+// isValidFilterSubject is isValidSubject but allows the NATS wildcard
+// tokens "*" and ">" (which must be the last token), for use on the
+// individual entries produced by parseFilterSubjects.
+func isValidFilterSubject(filter string) bool {
+	tokens := strings.Split(filter, ".")
+	if len(tokens) == 0 {
+		return false
+	}
+	for i, token := range tokens {
+		if token == ">" {
+			return i == len(tokens)-1
+		}
+		if token == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// isWildcardFilter reports whether filter contains a "*" or ">" token.
+func isWildcardFilter(filter string) bool {
+	for _, token := range strings.Split(filter, ".") {
+		if token == "*" || token == ">" {
+			return true
+		}
+	}
+	return false
+}
+
+// filterMatchesSubject reports whether the literal subject matches filter,
+// honoring "*" (exactly one token) and ">" (one or more trailing tokens,
+// must be last).
+func filterMatchesSubject(filter, subject string) bool {
+	filterTokens := strings.Split(filter, ".")
+	subjTokens := strings.Split(subject, ".")
+
+	for i, ft := range filterTokens {
+		if ft == ">" {
+			return i == len(filterTokens)-1 && i < len(subjTokens)
+		}
+		if i >= len(subjTokens) {
+			return false
+		}
+		if ft != "*" && ft != subjTokens[i] {
+			return false
+		}
+	}
+	return len(filterTokens) == len(subjTokens)
+}
+
 // Clear the ackTimer
 func (sub *subState) clearAckTimer() {
 	if sub.ackTimer != nil {
@@ -950,6 +3113,15 @@ func (sub *subState) clearAckTimer() {
 	}
 }
 
+// clearRateTimer stops and clears a pending rate-limit retry armed by
+// sendMsgToSub; see subState.rateTimer. Sub lock must be held.
+func (sub *subState) clearRateTimer() {
+	if sub.rateTimer != nil {
+		sub.rateTimer.Stop()
+		sub.rateTimer = nil
+	}
+}
+
 // Test if a subscription is a queue subscriber.
 func (sub *subState) isQueueSubscriber() bool {
 	return sub != nil && sub.qgroup != ""
@@ -960,6 +3132,46 @@ func (sub *subState) isDurable() bool {
 	return sub != nil && sub.durableName != ""
 }
 
+// isMultiSubject reports whether sub was registered against more than one
+// filter subject (see parseFilterSubjects), in which case per-channel
+// delivery state lives in lastSentByChannel rather than the legacy
+// lastSent/lastAcked fields alone.
+func (sub *subState) isMultiSubject() bool {
+	return len(sub.filters) > 1
+}
+
+// lastSentFor returns the last sequence delivered to sub on channel. For an
+// ordinary (single-subject) subscription this is just sub.lastSent;
+// otherwise it is looked up in lastSentByChannel, defaulting to 0 for a
+// channel the subscription hasn't seen a message on yet. Caller must hold
+// sub's lock.
+func (sub *subState) lastSentFor(channel string) uint64 {
+	if !sub.isMultiSubject() {
+		return sub.lastSent
+	}
+	return sub.lastSentByChannel[channel]
+}
+
+// setLastSentFor records seq as the last sequence delivered to sub on
+// channel. For an ordinary subscription this just sets lastSent; for a
+// multi-subject one it updates lastSentByChannel, additionally keeping
+// lastSent in sync when channel is the subscription's primary subject so
+// that SubscriptionInfo.LastSentSeq stays meaningful. Caller must hold
+// sub's lock.
+func (sub *subState) setLastSentFor(channel string, seq uint64) {
+	if !sub.isMultiSubject() {
+		sub.lastSent = seq
+		return
+	}
+	if sub.lastSentByChannel == nil {
+		sub.lastSentByChannel = make(map[string]uint64)
+	}
+	sub.lastSentByChannel[channel] = seq
+	if channel == sub.subject {
+		sub.lastSent = seq
+	}
+}
+
 // Used to generate durable key. This should not be called on non-durables.
 func (sub *subState) durableKey() string {
 	if sub.durableName == "" {
@@ -976,6 +3188,155 @@ func durableKey(sr *pb.SubscriptionRequest) string {
 	return fmt.Sprintf("%s-%s-%s", sr.ClientID, sr.Subject, sr.DurableName)
 }
 
+// SubscriptionInfo is a point-in-time snapshot of a subscription's state,
+// for monitoring/introspection. IsOffline is true for a durable whose
+// client has suspended it (see subStore.Suspend) but whose server-side
+// state (acksPending, lastSent) is still being held for a future resume.
+type SubscriptionInfo struct {
+	ClientID     string
+	Subject      string
+	QueueGroup   string
+	DurableName  string
+	IsDurable    bool
+	IsOffline    bool
+	PendingCount int
+	LastSentSeq  uint64
+	LastAckedSeq uint64
+	QueueMembers int
+	// AckInbox is the subject this subscription's acks are published to;
+	// exposed so a caller holding a SubscriptionInfo (e.g. the stantest
+	// subpackage) can drive a manual ack without its own copy of the
+	// client's Subscription handle.
+	AckInbox string
+}
+
+// Snapshot returns a SubscriptionInfo for every subscription registered in
+// ss, walking the plain subscribers and every queue group's members (the
+// durables map is just a by-durable-key index into the same subStates and
+// is not walked separately to avoid double-counting).
+func (ss *subStore) Snapshot() []SubscriptionInfo {
+	ss.RLock()
+	psubs := make([]*subState, len(ss.psubs))
+	copy(psubs, ss.psubs)
+	qsubs := make(map[string]*queueState, len(ss.qsubs))
+	for k, v := range ss.qsubs {
+		qsubs[k] = v
+	}
+	ss.RUnlock()
+
+	var infos []SubscriptionInfo
+	for _, sub := range psubs {
+		infos = append(infos, subInfo(sub, 0))
+	}
+	for _, qs := range qsubs {
+		qs.RLock()
+		members := len(qs.subs)
+		subs := make([]*subState, len(qs.subs))
+		copy(subs, qs.subs)
+		qs.RUnlock()
+		for _, sub := range subs {
+			infos = append(infos, subInfo(sub, members))
+		}
+	}
+	return infos
+}
+
+// subInfo builds a SubscriptionInfo for sub; queueMembers is 0 for a
+// non-queue subscription.
+func subInfo(sub *subState, queueMembers int) SubscriptionInfo {
+	sub.RLock()
+	defer sub.RUnlock()
+	return SubscriptionInfo{
+		ClientID:     sub.clientID,
+		Subject:      sub.subject,
+		QueueGroup:   sub.qgroup,
+		DurableName:  sub.durableName,
+		IsDurable:    sub.isDurable(),
+		IsOffline:    sub.isDurable() && sub.clientID == "",
+		PendingCount: len(sub.acksPending),
+		LastSentSeq:  sub.lastSent,
+		LastAckedSeq: sub.lastAcked,
+		QueueMembers: queueMembers,
+		AckInbox:     sub.ackInbox,
+	}
+}
+
+// OfflineDurables returns the subset of Snapshot's result for durables whose
+// client has disconnected, answering the common operational question "who's
+// fallen behind?" without cross-referencing multiple endpoints.
+func (ss *subStore) OfflineDurables() []SubscriptionInfo {
+	all := ss.Snapshot()
+	offline := all[:0:0]
+	for _, info := range all {
+		if info.IsOffline {
+			offline = append(offline, info)
+		}
+	}
+	return offline
+}
+
+// Subscriptions returns a SubscriptionInfo for every subscription owned by
+// clientID, across every channel - the cross-channel counterpart to
+// subStore.Snapshot, which only sees one channel's subscribers. Used by
+// monitoring code that indexes by client rather than by channel, and by the
+// stantest subpackage's Server.Subscriptions.
+func (s *stanServer) Subscriptions(clientID string) []SubscriptionInfo {
+	s.channels.RLock()
+	css := make([]*channelStore, 0, len(s.channels.channels))
+	for _, cs := range s.channels.channels {
+		css = append(css, cs)
+	}
+	s.channels.RUnlock()
+
+	var infos []SubscriptionInfo
+	for _, cs := range css {
+		for _, info := range cs.subs.Snapshot() {
+			if info.ClientID == clientID {
+				infos = append(infos, info)
+			}
+		}
+	}
+	return infos
+}
+
+// ChannelMessages returns up to count messages stored for subject starting
+// at fromSeq, or nil if subject has no channel yet; see msgStore.Msgs/
+// fileMsgStore.Msgs, which this just forwards to via the channel's Store.
+// Exposed for monitoring and for the stantest subpackage's Server.Messages.
+func (s *stanServer) ChannelMessages(subject string, fromSeq uint64, count int) []*pb.MsgProto {
+	cs := s.channels.Lookup(subject)
+	if cs == nil {
+		return nil
+	}
+	return cs.msgs.Msgs(fromSeq, count)
+}
+
+// ChannelSequence returns the first and last sequence numbers currently
+// stored for subject, or (0, 0) if subject has no channel yet.
+func (s *stanServer) ChannelSequence(subject string) (first, last uint64) {
+	cs := s.channels.Lookup(subject)
+	if cs == nil {
+		return 0, 0
+	}
+	return cs.msgs.FirstSequence(), cs.msgs.LastSequence()
+}
+
+// PullConvertSubject returns the subject a PullModeRequest must be sent to
+// in order to convert a queue member to pull mode (see processPullModeRequest).
+// It's nuid-derived per server instance (see DefaultPullConvertPrefix), so a
+// caller - the stantest subpackage, in particular - needs this to drive the
+// protocol directly in a test.
+func (s *stanServer) PullConvertSubject() string {
+	return s.pullConvertRequests
+}
+
+// FetchSubject returns the subject a FetchRequest must be sent to in order
+// to pull messages for a pull-mode queue member (see processFetchRequest).
+// Exposed for the same reason PullConvertSubject is.
+func (s *stanServer) FetchSubject() string {
+	return s.fetchRequests
+}
+
 // processSubscriptionRequest will process a subscription request.
 func (s *stanServer) processSubscriptionRequest(m *nats.Msg) {
 	sr := &pb.SubscriptionRequest{}
@@ -996,13 +3357,54 @@ func (s *stanServer) processSubscriptionRequest(m *nats.Msg) {
 		return
 	}
 
-	// Make sure subject is valid
-	if !isValidSubject(sr.Subject) {
+	// sr.Subject may be a single literal subject (the common case, unchanged
+	// from before) or a comma-separated list of filter subjects (see
+	// parseFilterSubjects) where entries after the first may use "*"/">"
+	// wildcards. The first filter must be a concrete subject: it anchors
+	// durable bookkeeping, StartPosition resolution and is used as the
+	// subscription's display subject.
+	//
+	// This list (sub.filters) is this tree's FilterSubjects: pb.SubscriptionRequest
+	// is generated from a vendored .proto and can't gain a repeated
+	// FilterSubjects field or a WildcardSubject flag, so a wildcard filter
+	// is recognized by syntax (isWildcardFilter) rather than an explicit
+	// opt-in flag - any filter after the first may freely be a literal
+	// subject or a wildcard.
+	filters := parseFilterSubjects(sr.Subject)
+	if len(filters) == 0 || !isValidFilterSubject(filters[0]) || isWildcardFilter(filters[0]) {
 		Debugf("STAN: [Client:%s] Invalid subject <%s> in subscription request from %s.",
 			sr.ClientID, sr.Subject, m.Subject)
 		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSubject)
 		return
 	}
+	for _, filter := range filters[1:] {
+		if !isValidFilterSubject(filter) {
+			Debugf("STAN: [Client:%s] Invalid subject <%s> in subscription request from %s.",
+				sr.ClientID, sr.Subject, m.Subject)
+			s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSubject)
+			return
+		}
+	}
+
+	// MaxDeliver (via the effective RedeliveryPolicy for this subject) must
+	// be >= 0; a negative value has no sane redelivery-limit meaning.
+	if s.channels.redeliveryPolicyFor(filters[0]).MaxDeliver < 0 {
+		Debugf("STAN: [Client:%s] Invalid MaxDeliver in subscription request from %s.",
+			sr.ClientID, m.Subject)
+		s.sendSubscriptionResponseErr(m.Reply, ErrInvalidMaxDeliver)
+		return
+	}
+
+	// Multi-subject filters aren't supported together with durables or
+	// queue groups: a queue group's lastSent/stalled bookkeeping and a
+	// durable's resume-by-durableKey lookup are both scoped to a single
+	// channel in this implementation.
+	if len(filters) > 1 && (sr.DurableName != "" || sr.QGroup != "") {
+		Debugf("STAN: [Client:%s] Invalid subscription request; multi-subject filters cannot be durable or a queue subscriber.",
+			sr.ClientID)
+		s.sendSubscriptionResponseErr(m.Reply, ErrMultiSubjectDurableOrQueue)
+		return
+	}
 
 	// ClientID must not be empty.
 	if sr.ClientID == "" {
@@ -1012,8 +3414,8 @@ func (s *stanServer) processSubscriptionRequest(m *nats.Msg) {
 		return
 	}
 
-	// Grab channel state, create a new one if needed.
-	cs := s.channels.LookupOrCreate(sr.Subject)
+	// Grab channel state for the anchor/primary filter, create a new one if needed.
+	cs := s.channels.LookupOrCreate(filters[0])
 
 	var sub *subState
 
@@ -1027,6 +3429,21 @@ func (s *stanServer) processSubscriptionRequest(m *nats.Msg) {
 			return
 		}
 
+		// A durable name and a queue group name are separate concepts in
+		// this server (ErrDurableQueue above forbids one subscription
+		// being both at once), but they still share a flat namespace from
+		// an operator's point of view: a monitoring tool or a later
+		// BindQueueGroup caller looking this channel up by name shouldn't
+		// find a durable where it expected a queue group. Reject reusing
+		// a name already bound to an existing queue group as a durable
+		// name.
+		if cs.subs.LookupQueueState(sr.DurableName) != nil {
+			Debugf("STAN: [Client:%s] Invalid subscription request; durable name %q already in use as a queue group.",
+				sr.ClientID, sr.DurableName)
+			s.sendSubscriptionResponseErr(m.Reply, ErrDeliverGroupMismatch)
+			return
+		}
+
 		if sub = cs.subs.LookupByDurable(durableKey(sr)); sub != nil {
 			sub.RLock()
 			clientID := sub.clientID
@@ -1045,13 +3462,32 @@ func (s *stanServer) processSubscriptionRequest(m *nats.Msg) {
 			// Also grab a new ackInbox and the sr's inbox.
 			sub.ackInbox = nats.NewInbox()
 			sub.inbox = sr.Inbox
+			wasSuspended := sub.suspended
+			sub.suspended = false
+			qs := sub.qstate
 			sub.Unlock()
+
+			// If this durable was previously Close()'d, it was removed
+			// from the psubs/qsubs list (but kept in the durables/acks
+			// lookups); re-attach it now that it is resuming.
+			if wasSuspended {
+				cs.subs.Lock()
+				cs.subs.acks[sub.ackInbox] = sub
+				if qs != nil {
+					qs.subs = append(qs.subs, sub)
+				} else {
+					cs.subs.psubs = append(cs.subs.psubs, sub)
+				}
+				cs.subs.Unlock()
+			}
 		}
 	}
 
-	// Check SequenceStart out of range
+	// Check SequenceStart out of range. Only the anchor channel (filters[0])
+	// is validated; see the comment above the initial-send fan-out below for
+	// why the same isn't done for additional multi-subject channels.
 	if sr.StartPosition == pb.StartPosition_SequenceStart {
-		if !s.startSequenceValid(sr.Subject, sr.StartSequence) {
+		if !s.startSequenceValid(filters[0], sr.StartSequence) {
 			Debugf("STAN: [Client:%s] Invalid start sequence in subscription request from %s.",
 				sr.ClientID, m.Subject)
 			s.sendSubscriptionResponseErr(m.Reply, ErrInvalidSequence)
@@ -1060,8 +3496,8 @@ func (s *stanServer) processSubscriptionRequest(m *nats.Msg) {
 	}
 	// Check for SequenceTime out of range
 	if sr.StartPosition == pb.StartPosition_TimeDeltaStart {
-		startTime := time.Now().UnixNano() - sr.StartTimeDelta
-		if !s.startTimeValid(sr.Subject, startTime) {
+		startTime := s.clock.Now().UnixNano() - sr.StartTimeDelta
+		if !s.startTimeValid(filters[0], startTime) {
 			Debugf("STAN: [Client:%s] Invalid start time in subscription request from %s.",
 				sr.ClientID, m.Subject)
 			s.sendSubscriptionResponseErr(m.Reply, ErrInvalidTime)
@@ -1070,20 +3506,80 @@ func (s *stanServer) processSubscriptionRequest(m *nats.Msg) {
 	}
 
 	// Create a subState if not retrieved from durable lookup above.
+	var extraChannels []*channelStore
 	if sub == nil {
+		weight := int(sr.MaxInFlight)
+		if weight <= 0 {
+			weight = 1
+		}
 		sub = &subState{
 			clientID:      sr.ClientID,
-			subject:       sr.Subject,
+			subject:       filters[0],
+			filters:       filters,
 			qgroup:        sr.QGroup,
 			inbox:         sr.Inbox,
 			ackInbox:      nats.NewInbox(),
 			durableName:   sr.DurableName,
 			maxInFlight:   int(sr.MaxInFlight),
+			weight:        weight,
 			ackWaitInSecs: time.Duration(sr.AckWaitInSecs),
-			acksPending:   make(map[uint64]*pb.MsgProto),
+			redelivery:    s.channels.redeliveryPolicyFor(filters[0]),
+			flowControl:   s.channels.flowControlFor(filters[0]),
+			pendingLimits: s.channels.pendingLimitsFor(filters[0]),
+			acksPending:   make(map[uint64]*pendingMsg),
+		}
+		// Store this subscription. This is also where a pending
+		// BindQueueGroup join (see CheckAndMarkPendingBind) is atomically
+		// rejected if the group no longer exists.
+		if err := cs.subs.Store(sub); err != nil {
+			Debugf("STAN: [Client:%s] Failed to join queue group %q: %v", sr.ClientID, sr.QGroup, err)
+			s.sendSubscriptionResponseErr(m.Reply, err)
+			return
+		}
+		// The group's dispatch policy is decided by whichever subject was
+		// used to form it (filters[0], since multi-subject queue
+		// subscriptions are rejected above) and captured once, when the
+		// first member joins.
+		if sub.qstate != nil {
+			sub.qstate.Lock()
+			if sub.qstate.dispatchPolicy == "" {
+				sub.qstate.dispatchPolicy = s.channels.dispatchPolicyFor(filters[0])
+			}
+			sub.qstate.Unlock()
+		}
+		// Register any additional filters beyond the anchor subject: a
+		// literal filter registers directly against its channel, a
+		// wildcard filter registers against every existing matching
+		// channel plus channelMap.wildcardSubs (once) so future channels
+		// pick it up too (see channelMap.New).
+		seen := map[*channelStore]bool{cs: true}
+		registeredWildcard := false
+		for _, filter := range filters[1:] {
+			if isWildcardFilter(filter) {
+				if !registeredWildcard {
+					s.channels.registerWildcardSub(sub)
+					registeredWildcard = true
+				}
+				s.channels.RLock()
+				for subj, candidate := range s.channels.channels {
+					if filterMatchesSubject(filter, subj) {
+						extraChannels = append(extraChannels, candidate)
+					}
+				}
+				s.channels.RUnlock()
+			} else {
+				ecs := s.channels.LookupOrCreate(filter)
+				extraChannels = append(extraChannels, ecs)
+			}
+		}
+		for _, ecs := range extraChannels {
+			if seen[ecs] {
+				continue
+			}
+			seen[ecs] = true
+			ecs.subs.Store(sub)
 		}
-		// Store this subscription
-		cs.subs.Store(sub)
+
 		// Also store in client
 		if client := s.clients.Lookup(sr.ClientID); client != nil {
 			client.AddSub(sub)
@@ -1119,12 +3615,33 @@ func (s *stanServer) processSubscriptionRequest(m *nats.Msg) {
 	case pb.StartPosition_LastReceived:
 		s.sendLastMessage(cs, sub)
 	case pb.StartPosition_TimeDeltaStart:
-		s.sendMessagesToSubFromTime(cs, sub, time.Now().UnixNano()-sr.StartTimeDelta)
+		s.sendMessagesToSubFromTime(cs, sub, s.clock.Now().UnixNano()-sr.StartTimeDelta)
 	case pb.StartPosition_SequenceStart:
 		s.sendMessagesFromSequence(cs, sub, sr.StartSequence)
 	case pb.StartPosition_First:
 		s.sendMessagesFromBeginning(cs, sub)
 	}
+
+	// For a multi-subject subscription, deliver the same initial backlog to
+	// every additional channel registered above. The out-of-range checks
+	// earlier in this function only validated the anchor channel
+	// (filters[0]); a SequenceStart/TimeDeltaStart that doesn't exist yet on
+	// a secondary channel simply yields no backlog there rather than
+	// failing the whole subscription.
+	for _, ecs := range extraChannels {
+		switch sr.StartPosition {
+		case pb.StartPosition_NewOnly:
+			s.sendNewOnly(ecs, sub)
+		case pb.StartPosition_LastReceived:
+			s.sendLastMessage(ecs, sub)
+		case pb.StartPosition_TimeDeltaStart:
+			s.sendMessagesToSubFromTime(ecs, sub, s.clock.Now().UnixNano()-sr.StartTimeDelta)
+		case pb.StartPosition_SequenceStart:
+			s.sendMessagesFromSequence(ecs, sub, sr.StartSequence)
+		case pb.StartPosition_First:
+			s.sendMessagesFromBeginning(ecs, sub)
+		}
+	}
 }
 
 // processAckMsg processes inbound acks from clients for delivered messages.
@@ -1151,9 +3668,13 @@ func (s *stanServer) processAck(cs *channelStore, sub *subState, ack *pb.Ack) {
 	Tracef("STAN: [Client:%s] removing pending ack, subj=%s, seq=%d.",
 		sub.clientID, sub.subject, ack.Sequence)
 
-	delete(sub.acksPending, ack.Sequence)
+	sub.releasePending(ack.Sequence)
+	if ack.Sequence > sub.lastAcked {
+		sub.lastAcked = ack.Sequence
+	}
 	stalled := sub.stalled
-	if len(sub.acksPending) < sub.maxInFlight {
+	withinBytes := sub.flowControl.MaxPendingBytes == 0 || sub.pendingBytes < sub.flowControl.MaxPendingBytes
+	if len(sub.acksPending) < sub.maxInFlight && withinBytes {
 		sub.stalled = false
 	}
 
@@ -1164,11 +3685,19 @@ func (s *stanServer) processAck(cs *channelStore, sub *subState, ack *pb.Ack) {
 				sub.clientID, sub.subject)
 			sub.clearAckTimer()
 		} else {
-			// FIXME(dlc) - This should be to next expiration, not simply +delta
+			// Reset to the earliest real deadline left in acksPending
+			// (each message's own backOffFor-derived nextDeliverAt) rather
+			// than a flat +ackWaitInSecs, so a RedeliveryPolicy.BackOff
+			// schedule keeps being honored across acks, not just on the
+			// first redelivery.
 			Tracef("STAN: [Client:%s] subj=%s, reset timer.",
 				sub.clientID, sub.subject)
 
-			sub.ackTimer.Reset(sub.ackWaitInSecs * time.Second)
+			delay := time.Duration(sub.earliestNextDeliverAt()-time.Now().UnixNano()) * time.Nanosecond
+			if delay <= 0 {
+				delay = time.Millisecond
+			}
+			sub.ackTimer.Reset(delay)
 		}
 	}
 
@@ -1204,10 +3733,15 @@ func (s *stanServer) sendAvailableMessagesToQueue(cs *channelStore, qs *queueSta
 
 	for nextSeq := qs.lastSent + 1; ; nextSeq++ {
 		nextMsg := cs.msgs.Lookup(nextSeq)
-		if nextMsg == nil || s.sendMsgToQueueGroup(qs, nextMsg) == false {
+		if nextMsg == nil || s.sendMsgToQueueGroup(cs, qs, nextMsg) == false {
 			break
 		}
 	}
+	// Wake any pull-mode member blocked in a FetchRequest: either a push
+	// member just advanced qs.lastSent, or every member is pull-mode and
+	// the message above is now sitting there for Fetch to claim - either
+	// way a waiter should re-check rather than wait out its MaxWait.
+	qs.notifyWaiters()
 }
 
 // Send any messages that are ready to be sent that have been queued.
@@ -1215,9 +3749,9 @@ func (s *stanServer) sendAvailableMessages(cs *channelStore, sub *subState) {
 	sub.Lock()
 	defer sub.Unlock()
 
-	for nextSeq := sub.lastSent + 1; ; nextSeq++ {
+	for nextSeq := sub.lastSentFor(cs.subject) + 1; ; nextSeq++ {
 		nextMsg := cs.msgs.Lookup(nextSeq)
-		if nextMsg == nil || s.sendMsgToSub(sub, nextMsg) == false {
+		if nextMsg == nil || s.sendMsgToSub(sub, cs.subject, nextMsg, 1) == false {
 			break
 		}
 	}
@@ -1237,9 +3771,9 @@ func (s *stanServer) startTimeValid(subject string, start int64) bool {
 // Check if a startSequence is valid.
 func (s *stanServer) startSequenceValid(subject string, seq uint64) bool {
 	cs := s.channels.Lookup(subject)
-	cs.msgs.RLock()
-	defer cs.msgs.RUnlock()
-	if seq > cs.msgs.last || seq < cs.msgs.first {
+	first := cs.msgs.FirstSequence()
+	last := cs.msgs.LastSequence()
+	if seq > last || seq < first {
 		return false
 	}
 	return true
@@ -1248,7 +3782,7 @@ func (s *stanServer) startSequenceValid(subject string, seq uint64) bool {
 // Send messages to the subscriber starting at startSeq.
 func (s *stanServer) sendMessagesFromSequence(cs *channelStore, sub *subState, startSeq uint64) {
 	sub.Lock()
-	sub.lastSent = startSeq - 1 // FIXME(dlc) - wrap?
+	sub.setLastSentFor(cs.subject, startSeq-1) // FIXME(dlc) - wrap?
 	qs := sub.qstate
 	sub.Unlock()
 
@@ -1264,17 +3798,20 @@ func (s *stanServer) sendMessagesFromSequence(cs *channelStore, sub *subState, s
 
 // Send messages to the subscriber starting at startTime. Assumes startTime is valid.
 func (s *stanServer) sendMessagesToSubFromTime(cs *channelStore, sub *subState, startTime int64) {
-	// Do binary search to find starting sequence.
-	cs.msgs.RLock()
-	index := sort.Search(len(cs.msgs.msgs), func(i int) bool {
-		m := cs.msgs.msgs[uint64(i)+cs.msgs.first]
-		if m.Timestamp >= startTime {
-			return true
+	// Stored sequences are contiguous from FirstSequence to LastSequence, so
+	// a linear scan through the Store interface finds the first message at
+	// or after startTime. (This used to binary-search msgStore's internal
+	// map directly; that no longer works now that cs.msgs is a Store
+	// interface value that may be backed by the file store too.)
+	first := cs.msgs.FirstSequence()
+	last := cs.msgs.LastSequence()
+	startSeq := last + 1
+	for seq := first; seq <= last; seq++ {
+		if m := cs.msgs.Lookup(seq); m != nil && m.Timestamp >= startTime {
+			startSeq = seq
+			break
 		}
-		return false
-	})
-	startSeq := uint64(index) + cs.msgs.first
-	cs.msgs.RUnlock()
+	}
 	Debugf("STAN: [Client:%s] Sending from time, subject=%s time=%d", sub.clientID, sub.subject, startTime)
 	s.sendMessagesFromSequence(cs, sub, startSeq)
 }
@@ -1295,7 +3832,7 @@ func (s *stanServer) sendLastMessage(cs *channelStore, sub *subState) {
 func (s *stanServer) sendNewOnly(cs *channelStore, sub *subState) {
 	lastSeq := cs.msgs.LastSequence()
 	sub.Lock()
-	sub.lastSent = lastSeq
+	sub.setLastSentFor(cs.subject, lastSeq)
 	sub.Unlock()
 
 	Debugf("STAN: [Client:%s] Sending new-only subject=%s, seq=%d.",
@@ -1305,6 +3842,7 @@ func (s *stanServer) sendNewOnly(cs *channelStore, sub *subState) {
 // Shutdown will close our NATS connection and shutdown any embedded NATS server.
 func (s *stanServer) Shutdown() {
 	Debugf("STAN: Shutting down.")
+	s.stopMonitor()
 	if s.nc != nil {
 		s.nc.Close()
 	}
@@ -1312,4 +3850,11 @@ func (s *stanServer) Shutdown() {
 		s.natsServer.Shutdown()
 		s.natsServer = nil
 	}
+	if s.channels != nil {
+		s.channels.RLock()
+		for _, cs := range s.channels.channels {
+			cs.msgs.Close()
+		}
+		s.channels.RUnlock()
+	}
 }
@@ -0,0 +1,102 @@
+// Copyright 2019 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/base64"
+
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// ChannelPath is the channel endpoint, e.g.
+// /streaming/channelsz?filter=foo.*&limit=N. Monitor serves the paginated
+// channel-name listing there (see Monitor.serveChannels); it does not read
+// channel=, msgs=, start= or count=, and does not serve PeekMessages or
+// BuildSubDetail output.
+const ChannelPath = "/streaming/channelsz"
+
+// DefaultChannelPeekCount bounds how many messages a single PeekMessages
+// call returns when count is not positive or is larger than this, so a
+// call can't be used to dump an entire channel's backlog at once.
+const DefaultChannelPeekCount = 100
+
+// MsgPeek describes a single message returned by PeekMessages. Payload is
+// only populated when PeekMessages is called with includePayload true,
+// which should be gated behind an operator opt-in (e.g. a future
+// Options.MonitorAllowPayloadPeek) since channel contents may be sensitive.
+type MsgPeek struct {
+	Sequence  uint64 `json:"seq"`
+	Timestamp int64  `json:"timestamp"`
+	Size      int    `json:"size"`
+	Payload   string `json:"payload,omitempty"` // base64-encoded
+}
+
+// PeekMessages returns up to count messages from store starting at seq
+// start (or the store's FirstSequence if start is 0), without acking or
+// otherwise affecting delivery state - a read-only peek for in-band channel
+// inspection. Missing sequences (already expired) are skipped rather than
+// returned as zero values.
+func PeekMessages(store stores.MsgStore, start uint64, count int, includePayload bool) []MsgPeek {
+	if count <= 0 || count > DefaultChannelPeekCount {
+		count = DefaultChannelPeekCount
+	}
+	if start == 0 {
+		start = store.FirstSequence()
+	}
+
+	peeks := make([]MsgPeek, 0, count)
+	for seq := start; len(peeks) < count; seq++ {
+		if seq > store.LastSequence() {
+			break
+		}
+		m := store.Lookup(seq)
+		if m == nil {
+			continue
+		}
+		p := MsgPeek{
+			Sequence:  m.Sequence,
+			Timestamp: m.Timestamp,
+			Size:      len(m.Data),
+		}
+		if includePayload {
+			p.Payload = base64.StdEncoding.EncodeToString(m.Data)
+		}
+		peeks = append(peeks, p)
+	}
+	return peeks
+}
+
+// SubDetail describes one subscription's redelivery/backlog state, as built
+// by BuildSubDetail.
+type SubDetail struct {
+	ClientID        string   `json:"client_id"`
+	DurableName     string   `json:"durable_name,omitempty"`
+	MaxInflight     int      `json:"max_inflight"`
+	PendingSeqs     []uint64 `json:"pending,omitempty"`
+	RedeliveryCount int      `json:"redelivery_count"`
+	Stalled         bool     `json:"stalled"`
+}
+
+// BuildSubDetail formats a SubDetail for subid out of subStore's pending-ack
+// state, summing each pending sequence's redelivery count and flagging the
+// subscription as stalled once its pending count reaches maxInflight.
+func BuildSubDetail(subStore stores.SubStore, subid uint64, clientID, durableName string, maxInflight int) SubDetail {
+	pending := subStore.PendingSeqs(subid)
+
+	var totalRedeliveries int
+	for _, seq := range pending {
+		_, count, ok := subStore.GetPending(subid, seq)
+		if ok {
+			totalRedeliveries += count
+		}
+	}
+
+	return SubDetail{
+		ClientID:        clientID,
+		DurableName:     durableName,
+		MaxInflight:     maxInflight,
+		PendingSeqs:     pending,
+		RedeliveryCount: totalRedeliveries,
+		Stalled:         maxInflight > 0 && len(pending) >= maxInflight,
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2019 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nats-io/go-nats"
+	"github.com/nats-io/nats-streaming-server/stores"
+)
+
+// HealthzPath and ReadyzPath are dedicated liveness/readiness probe
+// endpoints, alongside ClientsPath/ChannelPath, meant to return
+// small fast responses suitable for Kubernetes probes and load balancers.
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+)
+
+// DefaultHealthCheckTimeout bounds how long a single Check is allowed to run
+// before it is considered failed, so a wedged dependency can't hang the
+// probe response itself.
+const DefaultHealthCheckTimeout = 2 * time.Second
+
+// Check is a single named health or readiness check (e.g. "nats_connected",
+// "store_writable", "recovery_complete"). It should be cheap and side-effect
+// free wherever possible.
+type Check struct {
+	Name string
+	Run  func() error
+}
+
+// CheckResult is the outcome of running a single Check.
+type CheckResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// HealthChecker runs a set of Checks with a shared timeout and serves the
+// aggregate result as a JSON body enumerating each sub-check's status, so
+// operators can tell which dependency failed a probe instead of just seeing
+// a bare 503.
+type HealthChecker struct {
+	Timeout time.Duration
+	checks  []Check
+}
+
+// NewHealthChecker creates a HealthChecker with the given per-check timeout.
+// A zero timeout defaults to DefaultHealthCheckTimeout.
+func NewHealthChecker(timeout time.Duration) *HealthChecker {
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	return &HealthChecker{Timeout: timeout}
+}
+
+// AddCheck registers a Check to be run on every probe request.
+func (h *HealthChecker) AddCheck(c Check) {
+	h.checks = append(h.checks, c)
+}
+
+// run executes every check in parallel, bounding each one by h.Timeout, and
+// returns the per-check results plus whether all of them passed.
+func (h *HealthChecker) run() ([]CheckResult, bool) {
+	results := make([]CheckResult, len(h.checks))
+	allOK := true
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	wg.Add(len(h.checks))
+	for i, c := range h.checks {
+		go func(i int, c Check) {
+			defer wg.Done()
+
+			done := make(chan error, 1)
+			go func() { done <- c.Run() }()
+
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(h.Timeout):
+				err = errCheckTimedOut
+			}
+
+			r := CheckResult{Name: c.Name, OK: err == nil}
+			if err != nil {
+				r.Error = err.Error()
+			}
+
+			mu.Lock()
+			results[i] = r
+			if !r.OK {
+				allOK = false
+			}
+			mu.Unlock()
+		}(i, c)
+	}
+	wg.Wait()
+
+	return results, allOK
+}
+
+// ServeHTTP runs every registered check and writes a JSON body of
+// CheckResults, returning 200 if they all passed and 503 otherwise.
+func (h *HealthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	results, ok := h.run()
+
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		OK     bool          `json:"ok"`
+		Checks []CheckResult `json:"checks"`
+	}{OK: ok, Checks: results})
+}
+
+var errCheckTimedOut = errors.New("server: check timed out")
+
+// errNatsDisconnected is returned by NatsConnectedCheck when nc reports it
+// is not currently connected to the NATS server.
+var errNatsDisconnected = errors.New("server: not connected to NATS")
+
+// NatsConnectedCheck builds a /healthz Check that fails if nc is not
+// currently connected.
+func NatsConnectedCheck(nc *nats.Conn) Check {
+	return Check{
+		Name: "nats_connected",
+		Run: func() error {
+			if nc == nil || !nc.IsConnected() {
+				return errNatsDisconnected
+			}
+			return nil
+		},
+	}
+}
+
+// StoreWritableCheck builds a /healthz Check that fails if a bounded no-op
+// call against the store's state errors out, which is as close as we can
+// get to proving the store is writable without actually appending data that
+// a subscriber might see.
+func StoreWritableCheck(store stores.MsgStore) Check {
+	return Check{
+		Name: "store_writable",
+		Run: func() error {
+			_, _, err := store.State()
+			return err
+		},
+	}
+}
+
+// RecoveryCompleteCheck builds a /readyz Check that fails until recovered
+// reports true, for file-based stores where startup replays prior state
+// before the server is ready to serve subscribers.
+func RecoveryCompleteCheck(recovered func() bool) Check {
+	return Check{
+		Name: "recovery_complete",
+		Run: func() error {
+			if !recovered() {
+				return errRecoveryIncomplete
+			}
+			return nil
+		},
+	}
+}
+
+var errRecoveryIncomplete = errors.New("server: recovery not yet complete")
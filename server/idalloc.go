@@ -0,0 +1,40 @@
+// Copyright 2019 Apcera Inc. All rights reserved.
+
+package server
+
+import "sync/atomic"
+
+// IDAllocator hands out monotonically increasing IDs, the building block a
+// GetChannels/GetSubscriptions-style introspection call needs to page by
+// "start_id, max" instead of an offset that skews under concurrent
+// creation/deletion. It does not, on its own, amount to the gRPC
+// introspection service that originally motivated it: that would need a
+// generated pb/monitor package and its own server wiring, and this tree has
+// neither a vendored gRPC dependency nor a protoc toolchain to produce one.
+// IDAllocator and PageByID are kept as a standalone, general-purpose
+// pagination helper instead - not currently called by Monitor or anything
+// else in this package - for whichever pagination scheme (HTTP or gRPC)
+// ends up needing ID-based paging.
+type IDAllocator struct {
+	next uint64
+}
+
+// Next returns the next ID, starting at 1 so 0 can mean "unassigned".
+func (a *IDAllocator) Next() uint64 {
+	return atomic.AddUint64(&a.next, 1)
+}
+
+// PageByID returns the slice of ids (assumed sorted ascending) with id >=
+// startID, truncated to max entries, plus whether that page reached the
+// end of ids. A max <= 0 means unbounded.
+func PageByID(ids []uint64, startID uint64, max int) (page []uint64, end bool) {
+	i := 0
+	for i < len(ids) && ids[i] < startID {
+		i++
+	}
+	rest := ids[i:]
+	if max <= 0 || max >= len(rest) {
+		return rest, true
+	}
+	return rest[:max], false
+}
@@ -0,0 +1,289 @@
+// Copyright 2019 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultMaxMetricsChannels caps how many distinct channel label values
+// SetChannelStats will record before it starts dropping new channels,
+// protecting a scrape from blowing up on a deployment with millions of
+// channels. 0 means unbounded.
+const DefaultMaxMetricsChannels = 10000
+
+// MetricsPath is the path a Prometheus scraper should hit for metrics
+// exposition, as an alternative to polling the Serverz/Storez/Channelsz/
+// Clientsz JSON endpoints.
+const MetricsPath = "/streaming/metricsz"
+
+// Metrics holds the Prometheus collectors exported at MetricsPath. The
+// counters and gauges are derived from the same state that backs the
+// Serverz/Storez/Channelsz/Clientsz JSON snapshots; the histograms are fed
+// from the publish and ack code paths so operators can alert on latency
+// without writing a JSON-scraping exporter.
+//
+// A Metrics is self-contained and does not depend on a running StanServer,
+// so it can be embedded once that type exists in this tree; for now callers
+// update it directly from whatever code path observes the event.
+type Metrics struct {
+	// MaxChannels caps how many distinct channels SetChannelStats will
+	// track; see DefaultMaxMetricsChannels.
+	MaxChannels int
+
+	registry *prometheus.Registry
+
+	mu       sync.Mutex
+	channels map[string]struct{}
+
+	ChannelMessages      *prometheus.GaugeVec
+	ChannelBytes         *prometheus.GaugeVec
+	ChannelFirstSeq      *prometheus.GaugeVec
+	ChannelLastSeq       *prometheus.GaugeVec
+	ChannelSubscriptions *prometheus.GaugeVec
+
+	ClientSubscriptions *prometheus.GaugeVec
+
+	SubPending  *prometheus.GaugeVec
+	SubInflight *prometheus.GaugeVec
+	SubStalled  *prometheus.GaugeVec
+	SubAckWait  *prometheus.GaugeVec
+	SubLastSent *prometheus.GaugeVec
+
+	Clients prometheus.Gauge
+
+	TotalChannels      prometheus.Gauge
+	TotalClients       prometheus.Gauge
+	TotalSubscriptions prometheus.Gauge
+	TotalMsgs          prometheus.Gauge
+	TotalBytes         prometheus.Gauge
+
+	PublishLatency prometheus.Histogram
+	AckLatency     prometheus.Histogram
+}
+
+// NewMetrics creates a Metrics with all collectors registered under a fresh
+// registry, labeled with storeType (e.g. "memory", "file", "sql") so the
+// same dashboards work across store backends.
+func NewMetrics(storeType string) *Metrics {
+	labels := prometheus.Labels{"store_type": storeType}
+
+	m := &Metrics{
+		MaxChannels: DefaultMaxMetricsChannels,
+		registry:    prometheus.NewRegistry(),
+		channels:    make(map[string]struct{}),
+
+		ChannelMessages: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "stan",
+			Subsystem:   "channel",
+			Name:        "msgs",
+			Help:        "Number of messages stored in the channel.",
+			ConstLabels: labels,
+		}, []string{"channel"}),
+
+		ChannelBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "stan",
+			Subsystem:   "channel",
+			Name:        "bytes",
+			Help:        "Total size in bytes of messages stored in the channel.",
+			ConstLabels: labels,
+		}, []string{"channel"}),
+
+		ChannelFirstSeq: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "stan",
+			Subsystem:   "channel",
+			Name:        "first_seq",
+			Help:        "Sequence of the first message stored in the channel.",
+			ConstLabels: labels,
+		}, []string{"channel"}),
+
+		ChannelLastSeq: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "stan",
+			Subsystem:   "channel",
+			Name:        "last_seq",
+			Help:        "Sequence of the last message stored in the channel.",
+			ConstLabels: labels,
+		}, []string{"channel"}),
+
+		ChannelSubscriptions: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "stan",
+			Subsystem:   "channel",
+			Name:        "subscriptions",
+			Help:        "Number of subscriptions on the channel, by type.",
+			ConstLabels: labels,
+		}, []string{"channel", "type"}),
+
+		ClientSubscriptions: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "stan",
+			Subsystem:   "client",
+			Name:        "subscriptions",
+			Help:        "Number of subscriptions held by the client.",
+			ConstLabels: labels,
+		}, []string{"client"}),
+
+		SubPending: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "stan",
+			Subsystem:   "subscription",
+			Name:        "pending",
+			Help:        "Number of messages pending acknowledgement for the subscription.",
+			ConstLabels: labels,
+		}, []string{"channel", "client_id", "durable_name"}),
+
+		SubInflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "stan",
+			Subsystem:   "subscription",
+			Name:        "inflight",
+			Help:        "Number of messages delivered but not yet acknowledged, bounded by MaxInflight.",
+			ConstLabels: labels,
+		}, []string{"channel", "client_id", "durable_name"}),
+
+		SubStalled: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "stan",
+			Subsystem:   "subscription",
+			Name:        "stalled",
+			Help:        "1 if the subscription has hit MaxInflight and is waiting on acks, 0 otherwise.",
+			ConstLabels: labels,
+		}, []string{"channel", "client_id", "durable_name"}),
+
+		SubAckWait: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "stan",
+			Subsystem:   "subscription",
+			Name:        "ack_wait_seconds",
+			Help:        "Configured AckWait for the subscription, in seconds.",
+			ConstLabels: labels,
+		}, []string{"channel", "client_id", "durable_name"}),
+
+		SubLastSent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "stan",
+			Subsystem:   "subscription",
+			Name:        "last_sent_seq",
+			Help:        "Sequence number of the last message sent to the subscription.",
+			ConstLabels: labels,
+		}, []string{"channel", "client_id", "durable_name"}),
+
+		Clients: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   "stan",
+			Name:        "clients",
+			Help:        "Number of clients currently connected.",
+			ConstLabels: labels,
+		}),
+
+		TotalChannels: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   "stan",
+			Name:        "total_channels",
+			Help:        "Total number of channels.",
+			ConstLabels: labels,
+		}),
+
+		TotalClients: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   "stan",
+			Name:        "total_clients",
+			Help:        "Total number of connected clients.",
+			ConstLabels: labels,
+		}),
+
+		TotalSubscriptions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   "stan",
+			Name:        "total_subscriptions",
+			Help:        "Total number of subscriptions across all channels.",
+			ConstLabels: labels,
+		}),
+
+		TotalMsgs: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   "stan",
+			Name:        "total_msgs",
+			Help:        "Total number of messages stored across all channels.",
+			ConstLabels: labels,
+		}),
+
+		TotalBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   "stan",
+			Name:        "total_bytes",
+			Help:        "Total size in bytes of messages stored across all channels.",
+			ConstLabels: labels,
+		}),
+
+		PublishLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   "stan",
+			Subsystem:   "publish",
+			Name:        "latency_seconds",
+			Help:        "Time from receiving a publish request to storing it.",
+			ConstLabels: labels,
+			Buckets:     prometheus.DefBuckets,
+		}),
+
+		AckLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   "stan",
+			Subsystem:   "ack",
+			Name:        "latency_seconds",
+			Help:        "Time from sending a message to a subscription to receiving its ack.",
+			ConstLabels: labels,
+			Buckets:     prometheus.DefBuckets,
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.ChannelMessages,
+		m.ChannelBytes,
+		m.ChannelFirstSeq,
+		m.ChannelLastSeq,
+		m.ChannelSubscriptions,
+		m.ClientSubscriptions,
+		m.SubPending,
+		m.SubInflight,
+		m.SubStalled,
+		m.SubAckWait,
+		m.SubLastSent,
+		m.Clients,
+		m.TotalChannels,
+		m.TotalClients,
+		m.TotalSubscriptions,
+		m.TotalMsgs,
+		m.TotalBytes,
+		m.PublishLatency,
+		m.AckLatency,
+	)
+
+	return m
+}
+
+// SetChannelStats records a channel's msgs/bytes/first_seq/last_seq gauges.
+// Once MaxChannels distinct channels have been recorded, stats for any
+// further new channel are dropped (existing channels keep updating) so a
+// deployment with runaway channel cardinality can't blow up a scrape.
+func (m *Metrics) SetChannelStats(channel string, msgs int, bytes uint64, firstSeq, lastSeq uint64) {
+	m.mu.Lock()
+	_, known := m.channels[channel]
+	if !known {
+		if m.MaxChannels > 0 && len(m.channels) >= m.MaxChannels {
+			m.mu.Unlock()
+			return
+		}
+		m.channels[channel] = struct{}{}
+	}
+	m.mu.Unlock()
+
+	m.ChannelMessages.WithLabelValues(channel).Set(float64(msgs))
+	m.ChannelBytes.WithLabelValues(channel).Set(float64(bytes))
+	m.ChannelFirstSeq.WithLabelValues(channel).Set(float64(firstSeq))
+	m.ChannelLastSeq.WithLabelValues(channel).Set(float64(lastSeq))
+}
+
+// SetTotals sets the server-wide gauges.
+func (m *Metrics) SetTotals(channels, clients, subscriptions int, msgs int, bytes uint64) {
+	m.TotalChannels.Set(float64(channels))
+	m.TotalClients.Set(float64(clients))
+	m.TotalSubscriptions.Set(float64(subscriptions))
+	m.TotalMsgs.Set(float64(msgs))
+	m.TotalBytes.Set(float64(bytes))
+}
+
+// Handler returns the promhttp.Handler-compatible http.Handler to mount at
+// MetricsPath.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
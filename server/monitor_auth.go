@@ -0,0 +1,131 @@
+// Copyright 2019 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"net/http"
+)
+
+// Scope is a permission scope checked by RequireScope when wrapping a
+// monitoring endpoint. ScopeAdmin satisfies any scope requirement.
+type Scope string
+
+// The scopes recognized by the monitor auth middleware.
+const (
+	ScopeReadServer   Scope = "read:server"
+	ScopeReadClients  Scope = "read:clients"
+	ScopeReadChannels Scope = "read:channels"
+	ScopeAdmin        Scope = "admin"
+)
+
+// MonitorAuth authorizes an incoming monitoring request, returning the set
+// of scopes it was granted. ok is false if the request carried no
+// recognizable credentials at all (401, as opposed to 403 for credentials
+// that simply lack the needed scope).
+type MonitorAuth interface {
+	Authorize(r *http.Request) (scopes map[Scope]bool, ok bool)
+}
+
+// BearerTokenAuth authorizes requests by their "Authorization: Bearer <tok>"
+// header, looking tok up in the map to find its granted scopes.
+type BearerTokenAuth map[string][]Scope
+
+// Authorize implements MonitorAuth.
+func (b BearerTokenAuth) Authorize(r *http.Request) (map[Scope]bool, bool) {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) <= len(prefix) || h[:len(prefix)] != prefix {
+		return nil, false
+	}
+	scopes, ok := b[h[len(prefix):]]
+	if !ok {
+		return nil, false
+	}
+	return scopeSet(scopes), true
+}
+
+// BasicAuthEntry is one user's password and granted scopes, for BasicAuth.
+type BasicAuthEntry struct {
+	Password string
+	Scopes   []Scope
+}
+
+// BasicAuth authorizes requests using HTTP basic auth, keyed by username.
+type BasicAuth map[string]BasicAuthEntry
+
+// Authorize implements MonitorAuth.
+func (b BasicAuth) Authorize(r *http.Request) (map[Scope]bool, bool) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+	entry, found := b[user]
+	if !found || entry.Password != pass {
+		return nil, false
+	}
+	return scopeSet(entry.Scopes), true
+}
+
+// MTLSCommonNameAuth authorizes requests using the Common Name of the
+// client certificate presented during the TLS handshake, keyed by CN.
+type MTLSCommonNameAuth map[string][]Scope
+
+// Authorize implements MonitorAuth.
+func (m MTLSCommonNameAuth) Authorize(r *http.Request) (map[Scope]bool, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, false
+	}
+	cn := r.TLS.PeerCertificates[0].Subject.CommonName
+	scopes, ok := m[cn]
+	if !ok {
+		return nil, false
+	}
+	return scopeSet(scopes), true
+}
+
+// ChainAuth tries each MonitorAuth in turn, returning the first one that
+// recognizes the request's credentials. This lets an operator enable more
+// than one scheme (e.g. bearer tokens for automation, basic auth for
+// humans) on the same endpoint.
+type ChainAuth []MonitorAuth
+
+// Authorize implements MonitorAuth.
+func (c ChainAuth) Authorize(r *http.Request) (map[Scope]bool, bool) {
+	for _, a := range c {
+		if scopes, ok := a.Authorize(r); ok {
+			return scopes, true
+		}
+	}
+	return nil, false
+}
+
+func scopeSet(scopes []Scope) map[Scope]bool {
+	m := make(map[Scope]bool, len(scopes))
+	for _, s := range scopes {
+		m[s] = true
+	}
+	return m
+}
+
+// RequireScope wraps next with a MonitorAuth check, requiring scope (or
+// ScopeAdmin) to be among the scopes Authorize grants the request. It
+// responds 401 if the request carries no recognizable credentials at all,
+// and 403 if it does but lacks the needed scope.
+func RequireScope(auth MonitorAuth, scope Scope, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scopes, ok := auth.Authorize(r)
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !scopes[scope] && !scopes[ScopeAdmin] {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
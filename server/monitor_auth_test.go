@@ -0,0 +1,87 @@
+// Copyright 2019 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBearerTokenAuth(t *testing.T) {
+	auth := BearerTokenAuth{"good-token": {ScopeReadChannels}}
+
+	r := httptest.NewRequest(http.MethodGet, "/streaming/channelsz", nil)
+	if _, ok := auth.Authorize(r); ok {
+		t.Fatalf("expected no auth without a header")
+	}
+
+	r.Header.Set("Authorization", "Bearer bad-token")
+	if _, ok := auth.Authorize(r); ok {
+		t.Fatalf("expected no auth with an unknown token")
+	}
+
+	r.Header.Set("Authorization", "Bearer good-token")
+	scopes, ok := auth.Authorize(r)
+	if !ok || !scopes[ScopeReadChannels] {
+		t.Fatalf("expected ScopeReadChannels to be granted, got %v, ok=%v", scopes, ok)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	auth := BasicAuth{"admin": BasicAuthEntry{Password: "secret", Scopes: []Scope{ScopeAdmin}}}
+
+	r := httptest.NewRequest(http.MethodGet, "/streaming/serverz", nil)
+	if _, ok := auth.Authorize(r); ok {
+		t.Fatalf("expected no auth without credentials")
+	}
+
+	r.SetBasicAuth("admin", "wrong")
+	if _, ok := auth.Authorize(r); ok {
+		t.Fatalf("expected no auth with wrong password")
+	}
+
+	r.SetBasicAuth("admin", "secret")
+	scopes, ok := auth.Authorize(r)
+	if !ok || !scopes[ScopeAdmin] {
+		t.Fatalf("expected ScopeAdmin to be granted, got %v, ok=%v", scopes, ok)
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	auth := BearerTokenAuth{"reader": {ScopeReadClients}}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := RequireScope(auth, ScopeReadChannels, next)
+
+	cases := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"no credentials", "", http.StatusUnauthorized},
+		{"wrong scope", "reader", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/streaming/channelsz", nil)
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Fatalf("%s: expected status %d, got %d", c.name, c.status, w.Code)
+		}
+	}
+
+	admin := BearerTokenAuth{"admin": {ScopeAdmin}}
+	handler = RequireScope(admin, ScopeReadChannels, next)
+	r := httptest.NewRequest(http.MethodGet, "/streaming/channelsz", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected admin scope to satisfy any requirement, got status %d", w.Code)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2019 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errNoFlush is returned by serveEventStream if the ResponseWriter doesn't
+// support http.Flusher, which is required to push SSE frames incrementally.
+var errNoFlush = errors.New("server: response writer does not support flushing")
+
+// errTooManyWatchers is returned by monitorEventBus.Subscribe once
+// MaxWatchers concurrent ?watch=1 clients are already registered.
+var errTooManyWatchers = errors.New("server: too many concurrent monitor watchers")
+
+// DefaultMonitorEventBufSize is how many pending events a single watcher can
+// be behind before it is considered too slow and is dropped, so one stuck
+// HTTP client can't back up event delivery for everyone else.
+const DefaultMonitorEventBufSize = 256
+
+// DefaultMonitorMaxFrameSize bounds the encoded size of a single event frame.
+// Diffs larger than this (e.g. a Channelsz snapshot for thousands of
+// channels) are dropped rather than risk being split across SSE/websocket
+// frame boundaries by an intermediate proxy.
+const DefaultMonitorMaxFrameSize = 256 * 1024
+
+// DefaultMaxMonitorWatchers caps how many concurrent ?watch=1 clients a
+// monitorEventBus will accept, so a runaway curl loop can't hold thousands
+// of server-side goroutines open.
+const DefaultMaxMonitorWatchers = 100
+
+// DefaultWatchInterval is how often ServeWatch pushes a full snapshot when
+// ?interval= is not given.
+const DefaultWatchInterval = 5 * time.Second
+
+// MinWatchInterval is the smallest ?interval= ServeWatch honors; anything
+// shorter is clamped up to it.
+const MinWatchInterval = time.Second
+
+// MonitorEventType identifies what changed in a MonitorEvent.
+type MonitorEventType string
+
+// The set of monitor event types pushed to ?watch=1 watchers.
+const (
+	EventChannelAdded       MonitorEventType = "channel_added"
+	EventChannelRemoved     MonitorEventType = "channel_removed"
+	EventSubAdded           MonitorEventType = "sub_added"
+	EventSubRemoved         MonitorEventType = "sub_removed"
+	EventClientConnected    MonitorEventType = "client_connected"
+	EventClientDisconnected MonitorEventType = "client_disconnected"
+	// EventSnapshot carries a full Channelsz/Clientsz-style snapshot,
+	// pushed on every ?interval= tick in addition to the incremental
+	// events above.
+	EventSnapshot MonitorEventType = "snapshot"
+)
+
+// MonitorEvent is a single incremental diff pushed to a ?watch=1 watcher.
+// Data is whatever JSON-shaped payload makes sense for Type (e.g. a Clientsz
+// entry for EventClientConnected), left as interface{} so each of
+// ChannelPath and ClientsPath can carry its own shape.
+type MonitorEvent struct {
+	Type MonitorEventType `json:"type"`
+	Data interface{}      `json:"data"`
+}
+
+// monitorEventBus fans MonitorEvents passed to Publish out to any number of
+// watchers; HTTP handlers serving ?watch=1 call Subscribe and stream
+// whatever arrives until the request context is done. No server code path
+// calls Publish, so a ?watch=1 watcher receives only the EventSnapshot
+// frames ServeWatch writes itself.
+type monitorEventBus struct {
+	// MaxWatchers caps concurrent Subscribe callers; see
+	// DefaultMaxMonitorWatchers. Zero means unbounded.
+	MaxWatchers int
+
+	mu       sync.Mutex
+	watchers map[chan MonitorEvent]struct{}
+}
+
+func newMonitorEventBus() *monitorEventBus {
+	return &monitorEventBus{
+		MaxWatchers: DefaultMaxMonitorWatchers,
+		watchers:    make(map[chan MonitorEvent]struct{}),
+	}
+}
+
+// Subscribe registers a new watcher and returns the channel it should read
+// events from, plus an unsubscribe func to call once the watcher is done.
+// It fails with errTooManyWatchers once MaxWatchers are already registered.
+func (b *monitorEventBus) Subscribe() (ch chan MonitorEvent, unsubscribe func(), err error) {
+	b.mu.Lock()
+	if b.MaxWatchers > 0 && len(b.watchers) >= b.MaxWatchers {
+		b.mu.Unlock()
+		return nil, nil, errTooManyWatchers
+	}
+
+	ch = make(chan MonitorEvent, DefaultMonitorEventBufSize)
+	b.watchers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		if _, ok := b.watchers[ch]; ok {
+			delete(b.watchers, ch)
+			close(ch)
+		}
+		b.mu.Unlock()
+	}, nil
+}
+
+// Publish fans ev out to every current watcher. A watcher whose buffer is
+// full is considered too slow and is dropped rather than blocking Publish,
+// since Publish is called from hot server code paths.
+func (b *monitorEventBus) Publish(ev MonitorEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.watchers {
+		select {
+		case ch <- ev:
+		default:
+			delete(b.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+// ParseWatchInterval reads ?interval= off r, defaulting to
+// DefaultWatchInterval and clamping anything below MinWatchInterval up to
+// it.
+func ParseWatchInterval(r *http.Request) time.Duration {
+	raw := r.URL.Query().Get("interval")
+	if raw == "" {
+		return DefaultWatchInterval
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < MinWatchInterval {
+		return MinWatchInterval
+	}
+	return d
+}
+
+// writeSSEFrame writes a single Server-Sent Events frame for ev to w and
+// flushes it. Frames larger than DefaultMonitorMaxFrameSize are dropped
+// rather than sent truncated.
+func writeSSEFrame(w http.ResponseWriter, flusher http.Flusher, ev MonitorEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil || len(b) > DefaultMonitorMaxFrameSize {
+		return nil
+	}
+	if _, err := w.Write([]byte("event: " + string(ev.Type) + "\ndata: ")); err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte("\n\n")); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// serveEventStream writes ev as it arrives on ch as a Server-Sent Events
+// stream until the request is done.
+func serveEventStream(w http.ResponseWriter, r *http.Request, ch <-chan MonitorEvent) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errNoFlush
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := writeSSEFrame(w, flusher, ev); err != nil {
+				return err
+			}
+		case <-r.Context().Done():
+			return nil
+		}
+	}
+}
+
+// ServeWatch is the ?watch=1 handler body shared by ChannelPath and
+// ClientsPath: it pushes a full EventSnapshot (from snapshot) every
+// ParseWatchInterval(r), interleaved with whatever incremental events
+// (EventChannelAdded/Removed, EventSubAdded/Removed, ...) bus publishes in
+// between, until the watcher cap is hit or the client disconnects.
+func ServeWatch(w http.ResponseWriter, r *http.Request, bus *monitorEventBus, snapshot func() interface{}) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errNoFlush
+	}
+
+	ch, unsubscribe, err := bus.Subscribe()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return err
+	}
+	defer unsubscribe()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if err := writeSSEFrame(w, flusher, MonitorEvent{Type: EventSnapshot, Data: snapshot()}); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(ParseWatchInterval(r))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := writeSSEFrame(w, flusher, ev); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := writeSSEFrame(w, flusher, MonitorEvent{Type: EventSnapshot, Data: snapshot()}); err != nil {
+				return err
+			}
+		case <-r.Context().Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// ErrInvalidCursor is returned when a cursor= query parameter doesn't decode
+// to a value this process produced, e.g. because the underlying data set
+// changed in a way that invalidated it.
+var ErrInvalidCursor = errors.New("server: invalid cursor")
+
+// ListQuery is the filter/sort/pagination parameters shared by the
+// Channelsz and Clientsz handlers: filter= (glob), sort= (field name), and
+// cursor= (an opaque token from a previous page), in place of the old
+// offset+limit scheme that re-scans the whole map on every page and shifts
+// results if the map mutates in between. Sort is parsed but not used by
+// Monitor's listing handlers, which always order by name.
+type ListQuery struct {
+	Filter string
+	Sort   string
+	Cursor string
+	Limit  int
+}
+
+// ParseListQuery reads a ListQuery off an http.Request's query string.
+func ParseListQuery(r *http.Request) ListQuery {
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	return ListQuery{
+		Filter: q.Get("filter"),
+		Sort:   q.Get("sort"),
+		Cursor: q.Get("cursor"),
+		Limit:  limit,
+	}
+}
+
+// FilterKeys returns the subset of keys matching pattern (a path.Match glob,
+// e.g. "foo.*"). An empty pattern matches everything.
+func FilterKeys(keys []string, pattern string) ([]string, error) {
+	if pattern == "" {
+		return keys, nil
+	}
+	out := keys[:0:0]
+	for _, k := range keys {
+		ok, err := path.Match(pattern, k)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out = append(out, k)
+		}
+	}
+	return out, nil
+}
+
+// SortKeysBy sorts keys in place using less to compare the values behind
+// each key, for a "sort=msgs"-style field name translated by the caller into
+// a less func. Ties are broken on the key itself so the order - and
+// therefore cursors derived from it - stays stable across calls.
+func SortKeysBy(keys []string, less func(a, b string) bool) {
+	sort.Slice(keys, func(i, j int) bool {
+		if less != nil && less(keys[i], keys[j]) {
+			return true
+		}
+		if less != nil && less(keys[j], keys[i]) {
+			return false
+		}
+		return keys[i] < keys[j]
+	})
+}
+
+// EncodeCursor produces the opaque cursor token for a page that ended at
+// lastKey, to be returned to the caller and echoed back as cursor= on the
+// next request.
+func EncodeCursor(lastKey string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+}
+
+// DecodeCursor reverses EncodeCursor. An empty cursor decodes to "" (start
+// from the beginning) without error.
+func DecodeCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+	return string(b), nil
+}
+
+// ApplyCursor returns the slice of keys strictly after the key encoded in
+// cursor. It compares keys as strings, so keys must be in ascending string
+// order (SortKeysBy with a nil less); for any other order the result is not
+// the next page. An empty cursor returns keys unchanged.
+func ApplyCursor(keys []string, cursor string) ([]string, error) {
+	lastKey, err := DecodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	if lastKey == "" {
+		return keys, nil
+	}
+	for i, k := range keys {
+		if k > lastKey {
+			return keys[i:], nil
+		}
+	}
+	return nil, nil
+}
+
+// Paginate applies limit to keys and returns the page plus the cursor to use
+// for the next page, which is empty once there is nothing left to return.
+func Paginate(keys []string, limit int) (page []string, nextCursor string) {
+	if limit <= 0 || limit >= len(keys) {
+		return keys, ""
+	}
+	return keys[:limit], EncodeCursor(keys[limit-1])
+}
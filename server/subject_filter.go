@@ -0,0 +1,40 @@
+// Copyright 2019 Apcera Inc. All rights reserved.
+
+package server
+
+import "strings"
+
+// tokenSep separates tokens in a NATS subject, e.g. "foo.bar.baz".
+const tokenSep = "."
+
+// MatchesSubjectFilter reports whether subject matches filter using NATS
+// subject wildcard semantics: "*" matches exactly one token, ">" matches
+// one-or-more trailing tokens and must be the last token in filter. A
+// filter with no wildcards must match subject exactly. This backs
+// ChannelPath's ?filter= query parameter (see Monitor.serveChannels),
+// applied before the cursor and limit so a page holds only matching channel
+// names. The listing response carries no Count or Total.
+func MatchesSubjectFilter(subject, filter string) bool {
+	if filter == "" {
+		return true
+	}
+
+	subjTokens := strings.Split(subject, tokenSep)
+	filterTokens := strings.Split(filter, tokenSep)
+
+	for i, ft := range filterTokens {
+		if ft == ">" {
+			// ">" must be the last token and requires at least one
+			// remaining token in subject to match.
+			return i == len(filterTokens)-1 && i < len(subjTokens)
+		}
+		if i >= len(subjTokens) {
+			return false
+		}
+		if ft != "*" && ft != subjTokens[i] {
+			return false
+		}
+	}
+
+	return len(filterTokens) == len(subjTokens)
+}
@@ -0,0 +1,30 @@
+// Copyright 2019 Apcera Inc. All rights reserved.
+
+package server
+
+import "testing"
+
+func TestMatchesSubjectFilter(t *testing.T) {
+	cases := []struct {
+		subject string
+		filter  string
+		match   bool
+	}{
+		{"foo.bar", "", true},
+		{"foo.bar", "foo.bar", true},
+		{"foo.bar", "foo.baz", false},
+		{"foo.bar", "foo.*", true},
+		{"foo.bar.baz", "foo.*", false},
+		{"foo.bar", "*.bar", true},
+		{"foo", "*.bar", false},
+		{"foo.bar.baz", "foo.>", true},
+		{"foo", "foo.>", false},
+		{"foo.bar.baz.qux", "foo.bar.>", true},
+		{"foo.bar", "foo.bar.>", false},
+	}
+	for _, c := range cases {
+		if got := MatchesSubjectFilter(c.subject, c.filter); got != c.match {
+			t.Errorf("MatchesSubjectFilter(%q, %q) = %v, want %v", c.subject, c.filter, got, c.match)
+		}
+	}
+}
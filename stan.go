@@ -4,6 +4,7 @@
 package stan
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"runtime"
@@ -11,6 +12,7 @@ import (
 	"time"
 
 	"github.com/nats-io/nats"
+	"github.com/nats-io/nuid"
 )
 
 const (
@@ -20,6 +22,9 @@ const (
 	DefaultDiscoverPrefix     = "_STAN.discover"
 	DefaultACKPrefix          = "_STAN.acks"
 	DefaultMaxPubAcksInflight = 16384
+	DefaultPingInterval       = 5 * time.Second
+	DefaultPingMaxOut         = 3
+	defaultPingResponseWait   = 2 * time.Second
 )
 
 // Conn represents a connection to the STAN subsystem. It can Publish and
@@ -31,6 +36,10 @@ type Conn interface {
 	// Publish with Reply
 	PublishWithReply(subject, reply string, data []byte) error
 	PublishAsyncWithReply(subject, reply string, data []byte, ah AckHandler) (string, error)
+	// Publish with a context, so a caller can bound or cancel the wait for
+	// an ACK without relying solely on the connection-wide PubAckWait.
+	PublishWithContext(ctx context.Context, subject string, data []byte) error
+	PublishAsyncWithContext(ctx context.Context, subject string, data []byte, ah AckHandler) (string, error)
 
 	// Subscribe
 	Subscribe(subject string, cb MsgHandler, opts ...SubscriptionOption) (Subscription, error)
@@ -44,15 +53,20 @@ type Conn interface {
 
 // Errors
 var (
-	ErrConnectReqTimeout = errors.New("stan: connect request timeout")
-	ErrCloseReqTimeout   = errors.New("stan: close request timeout")
-	ErrConnectionClosed  = errors.New("stan: connection closed")
-	ErrTimeout           = errors.New("stan: publish ack timeout")
-	ErrBadAck            = errors.New("stan: malformed ack")
-	ErrBadSubscription   = errors.New("stan: invalid subscription")
-	ErrBadConnection     = errors.New("stan: invalid connection")
-	ErrManualAck         = errors.New("stan: can not manually ack in auto-ack mode")
-	ErrNilMsg            = errors.New("stan: nil message")
+	ErrConnectReqTimeout   = errors.New("stan: connect request timeout")
+	ErrCloseReqTimeout     = errors.New("stan: close request timeout")
+	ErrConnectionClosed    = errors.New("stan: connection closed")
+	ErrTimeout             = errors.New("stan: publish ack timeout")
+	ErrBadAck              = errors.New("stan: malformed ack")
+	ErrBadSubscription     = errors.New("stan: invalid subscription")
+	ErrBadConnection       = errors.New("stan: invalid connection")
+	ErrManualAck           = errors.New("stan: can not manually ack in auto-ack mode")
+	ErrNilMsg              = errors.New("stan: nil message")
+	ErrSlowConsumer        = errors.New("stan: slow consumer, messages dropped")
+	ErrMaxPubAcksInflight  = errors.New("stan: max publish acks in flight reached")
+	ErrInvalidPingInterval = errors.New("stan: ping interval must be positive")
+	ErrInvalidPingMaxOut   = errors.New("stan: ping max out must be greater than 1")
+	ErrConnectionLost      = errors.New("stan: server not responding to pings, connection lost")
 )
 
 // AckHandler is used for Async Publishing to provide status of the ack.
@@ -68,6 +82,11 @@ type Options struct {
 	AckTimeout         time.Duration
 	DiscoverPrefix     string
 	MaxPubAcksInflight int
+	PingInterval       time.Duration
+	PingMaxOut         int
+	ConnectionLostCB   func(Conn, error)
+	Logger             Logger
+	TraceHooks         TraceHooks
 }
 
 var DefaultOptions = Options{
@@ -76,6 +95,9 @@ var DefaultOptions = Options{
 	AckTimeout:         DefaultAckWait,
 	DiscoverPrefix:     DefaultDiscoverPrefix,
 	MaxPubAcksInflight: DefaultMaxPubAcksInflight,
+	PingInterval:       DefaultPingInterval,
+	PingMaxOut:         DefaultPingMaxOut,
+	Logger:             NoopLogger{},
 }
 
 // Option is a function on the options for a connection.
@@ -98,34 +120,112 @@ func PubAckWait(t time.Duration) Option {
 	}
 }
 
+// MaxPubAcksInflight is an Option to set the maximum number of published
+// messages without outstanding ACKs from the server.
+func MaxPubAcksInflight(max int) Option {
+	return func(o *Options) error {
+		o.MaxPubAcksInflight = max
+		return nil
+	}
+}
+
+// Pings is an Option to set the client-to-server ping interval (in seconds)
+// and the number of consecutive unanswered pings after which the connection
+// is considered lost. This lets a client detect a silent server or network
+// failure, which today is otherwise invisible until the next PublishAsync
+// times out or a Subscribe callback simply stops firing.
+func Pings(interval, maxOut int) Option {
+	return func(o *Options) error {
+		if interval <= 0 {
+			return ErrInvalidPingInterval
+		}
+		if maxOut <= 1 {
+			return ErrInvalidPingMaxOut
+		}
+		o.PingInterval = time.Duration(interval) * time.Second
+		o.PingMaxOut = maxOut
+		return nil
+	}
+}
+
+// SetConnectionLostHandler is an Option to set the callback invoked when the
+// client gives up on the server responding to pings and considers the
+// connection lost. The Conn passed to cb is already closed.
+func SetConnectionLostHandler(cb func(Conn, error)) Option {
+	return func(o *Options) error {
+		o.ConnectionLostCB = cb
+		return nil
+	}
+}
+
 // A conn represents a bare connection to a stan cluster.
 type conn struct {
 	sync.Mutex
-	clientID        string
-	serverID        string
-	pubPrefix       string // Publish prefix set by stan, append our subject.
-	subRequests     string // Subject to send subscription requests.
-	unsubRequests   string // Subject to send unsubscribe requests.
-	closeRequests   string // Subject to send close requests.
-	ackSubject      string // publish acks
-	ackSubscription *nats.Subscription
-	subMap          map[string]*subscription
-	pubAckMap       map[string]*ack
-	pubAckChan      chan (struct{})
-	opts            Options
-	nc              *nats.Conn
-}
-
-// Closure for ack contexts.
+	clientID string
+	serverID string
+	// clusterID is the stanClusterID passed to Connect, kept around so
+	// subscribe can derive the exclusive-queue side-channel subject (see
+	// DefaultExclusiveQueuePrefix) the same deterministic way the server
+	// does, without needing a discovery round trip for it.
+	clusterID        string
+	pubPrefix        string // Publish prefix set by stan, append our subject.
+	subRequests      string // Subject to send subscription requests.
+	unsubRequests    string // Subject to send unsubscribe requests.
+	subCloseRequests string // Subject to send subscription close (suspend) requests.
+	closeRequests    string // Subject to send close requests.
+	ackSubject       string // publish acks
+	ackSubscription  *nats.Subscription
+	subMap           map[string]*subscription
+	pubAckMap        map[string]*ack
+	pubAckChan       chan (struct{})
+	opts             Options
+	nc               *nats.Conn
+
+	// Doubly-linked list of in-flight publish acks, ordered by expiration.
+	// Because AckTimeout is uniform per connection, new acks always expire
+	// after every ack already in the list, so appending at the tail keeps
+	// the list sorted with no per-ack timer.
+	pubAckHead        *ack
+	pubAckTail        *ack
+	pubAckTimeoutCh   chan struct{}
+	pubAckTimeoutQuit chan struct{}
+	pubAckTimerWG     sync.WaitGroup
+
+	connID       string // Unique ID for this connection, included in every Ping.
+	pingRequests string // Subject to send pings to, from ConnectResponse.
+	pingInfo     pingInfo
+}
+
+// pingInfo holds the mutable state for the client-to-server ping goroutine,
+// kept separate from conn's own lock since pings run on their own ticker
+// independent of publish/subscribe activity.
+type pingInfo struct {
+	sync.Mutex
+	out  int // consecutive unanswered pings
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Closure for ack contexts. prev/next link the ack into its conn's
+// pubAckHead/pubAckTail list.
 type ack struct {
-	t  *time.Timer
-	ah AckHandler
+	guid   string
+	expire int64 // UnixNano
+	ah     AckHandler
+	prev   *ack
+	next   *ack
+
+	// done, if non-nil, is closed exactly once when the ack leaves
+	// pubAckMap (acked, timed out, or connection lost). It lets a
+	// watchAckContext goroutine stop waiting on ctx.Done() once the ack
+	// has already been resolved some other way.
+	done chan struct{}
 }
 
 // Connect will form a connection to the STAN subsystem.
 func Connect(stanClusterID, clientID string, options ...Option) (Conn, error) {
 	// Process Options
-	c := conn{clientID: clientID, opts: DefaultOptions}
+	c := conn{clientID: clientID, clusterID: stanClusterID, opts: DefaultOptions}
 	for _, opt := range options {
 		if err := opt(&c.opts); err != nil {
 			return nil, err
@@ -165,7 +265,10 @@ func Connect(stanClusterID, clientID string, options ...Option) (Conn, error) {
 	c.pubPrefix = cr.PubPrefix
 	c.subRequests = cr.SubRequests
 	c.unsubRequests = cr.UnsubRequests
+	c.subCloseRequests = cr.SubCloseRequests
 	c.closeRequests = cr.CloseRequests
+	c.pingRequests = cr.PingRequests
+	c.connID = newGUID()
 
 	// Setup the ACK subscription
 	c.ackSubject = fmt.Sprintf("%s.%s", DefaultACKPrefix, newGUID())
@@ -180,6 +283,17 @@ func Connect(stanClusterID, clientID string, options ...Option) (Conn, error) {
 
 	c.pubAckChan = make(chan struct{}, c.opts.MaxPubAcksInflight)
 
+	// Start the single goroutine that expires publish acks past AckTimeout.
+	c.pubAckTimeoutCh = make(chan struct{}, 1)
+	c.pubAckTimeoutQuit = make(chan struct{})
+	c.pubAckTimerWG.Add(1)
+	go c.ackTimeoutLoop()
+
+	// Start the client-to-server ping goroutine.
+	c.pingInfo.quit = make(chan struct{})
+	c.pingInfo.wg.Add(1)
+	go c.pingLoop()
+
 	// Attach a finalizer
 	runtime.SetFinalizer(&c, func(sc *conn) { sc.Close() })
 
@@ -193,15 +307,14 @@ func (sc *conn) Close() error {
 	}
 
 	sc.Lock()
-	defer sc.Unlock()
 
 	if sc.nc == nil {
+		sc.Unlock()
 		return ErrBadConnection
 	}
 
 	// Capture for NATS calls below.
 	nc := sc.nc
-	defer nc.Close()
 
 	// Signals we are closed.
 	sc.nc = nil
@@ -211,6 +324,28 @@ func (sc *conn) Close() error {
 		sc.ackSubscription.Unsubscribe()
 	}
 
+	quit := sc.pubAckTimeoutQuit
+	sc.Unlock()
+
+	// Stop the pub ack expiration goroutine before tearing down the NATS
+	// connection underneath it.
+	if quit != nil {
+		close(quit)
+		sc.signalAckTimeout()
+		sc.pubAckTimerWG.Wait()
+	}
+
+	// Stop the ping goroutine.
+	sc.pingInfo.Lock()
+	pingQuit := sc.pingInfo.quit
+	sc.pingInfo.Unlock()
+	if pingQuit != nil {
+		close(pingQuit)
+		sc.pingInfo.wg.Wait()
+	}
+
+	defer nc.Close()
+
 	req := &CloseRequest{ClientID: sc.clientID}
 	b, _ := req.Marshal()
 	reply, err := nc.Request(sc.closeRequests, b, sc.opts.ConnectTimeout)
@@ -232,13 +367,22 @@ func (sc *conn) Close() error {
 	return nil
 }
 
+// log returns the connection's Logger, defaulting to a no-op if none was
+// configured via SetLogger.
+func (sc *conn) log() Logger {
+	if l := sc.opts.Logger; l != nil {
+		return l
+	}
+	return NoopLogger{}
+}
+
 // Process an ack from the STAN cluster
 func (sc *conn) processAck(m *nats.Msg) {
 	pa := &PubAck{}
 	err := pa.Unmarshal(m.Data)
 	if err != nil {
-		// FIXME, make closure to have context?
-		fmt.Printf("Error processing unmarshal\n")
+		sc.log().Errorf("stan: error unmarshaling ack: %v", err)
+		return
 	}
 
 	// Remove
@@ -247,6 +391,11 @@ func (sc *conn) processAck(m *nats.Msg) {
 	// Perform the ackHandler callback
 	if a != nil && a.ah != nil {
 		a.ah(pa.Id, nil)
+	} else if a == nil {
+		sc.log().Debugf("stan: ack for unknown guid %q (already timed out?)", pa.Id)
+	}
+	if hook := sc.opts.TraceHooks.OnAck; hook != nil {
+		hook(pa.Id, nil)
 	}
 }
 
@@ -278,10 +427,46 @@ func (sc *conn) PublishWithReply(subject, reply string, data []byte) error {
 // PublishAsyncWithReply will publish to the cluster and asynchronously
 // process the ACK or error state. It will return the GUID for the message being sent.
 func (sc *conn) PublishAsyncWithReply(subject, reply string, data []byte, ah AckHandler) (string, error) {
+	return sc.publishAsync(context.Background(), subject, reply, data, ah)
+}
+
+// PublishWithContext will publish to the cluster and wait for an ACK, or
+// until ctx is done, whichever comes first. If ctx carries a deadline, it
+// replaces AckTimeout for this publish.
+func (sc *conn) PublishWithContext(ctx context.Context, subject string, data []byte) error {
+	ch := make(chan error, 1)
+	ah := func(guid string, err error) {
+		ch <- err
+	}
+	if _, err := sc.publishAsync(ctx, subject, "", data, ah); err != nil {
+		return err
+	}
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PublishAsyncWithContext is the context-aware counterpart to PublishAsync.
+// If ctx carries a deadline, it replaces AckTimeout for this publish. If ctx
+// is done before the server acks, the ack is removed from pubAckMap and ah
+// is invoked with ctx.Err().
+func (sc *conn) PublishAsyncWithContext(ctx context.Context, subject string, data []byte, ah AckHandler) (string, error) {
+	return sc.publishAsync(ctx, subject, "", data, ah)
+}
+
+// publishAsync is the shared implementation behind PublishAsyncWithReply and
+// PublishAsyncWithContext. It will return the GUID for the message being sent.
+func (sc *conn) publishAsync(ctx context.Context, subject, reply string, data []byte, ah AckHandler) (string, error) {
 	subj := fmt.Sprintf("%s.%s", sc.pubPrefix, subject)
 	pe := &PubMsg{Id: newGUID(), Subject: subject, Reply: reply, Data: data}
 	b, _ := pe.Marshal()
-	a := &ack{ah: ah}
+	a := &ack{guid: pe.Id, ah: ah}
+	if done := ctx.Done(); done != nil {
+		a.done = make(chan struct{})
+	}
 
 	sc.Lock()
 	if sc.nc == nil {
@@ -293,6 +478,11 @@ func (sc *conn) PublishAsyncWithReply(subject, reply string, data []byte, ah Ack
 	// snapshot
 	ackSubject := sc.ackSubject
 	ackTimeout := sc.opts.AckTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); remaining > 0 {
+			ackTimeout = remaining
+		}
+	}
 	pac := sc.pubAckChan
 	sc.Unlock()
 
@@ -305,45 +495,309 @@ func (sc *conn) PublishAsyncWithReply(subject, reply string, data []byte, ah Ack
 		return "", err
 	}
 
-	// Setup the timer for expiration.
+	if hook := sc.opts.TraceHooks.OnPublish; hook != nil {
+		hook(pe.Id, subject)
+	}
+
+	// Append to the tail of the pending-ack list so the single expiration
+	// goroutine can pick it up; since AckTimeout is the same for every ack,
+	// appending at the tail keeps the list sorted by expiration.
 	sc.Lock()
-	a.t = time.AfterFunc(ackTimeout, func() {
-		sc.removeAck(pe.Id)
-		if a.ah != nil {
-			ah(pe.Id, ErrTimeout)
-		}
-	})
+	a.expire = time.Now().UnixNano() + int64(ackTimeout)
+	wasEmpty := sc.pubAckHead == nil
+	sc.appendAckLocked(a)
 	sc.Unlock()
 
+	if wasEmpty {
+		sc.signalAckTimeout()
+	}
+
+	if a.done != nil {
+		go sc.watchAckContext(ctx, a)
+	}
+
 	return pe.Id, nil
 }
 
-// removeAck removes the ack from the pubAckMap and cancels any state, e.g. timers
+// watchAckContext races ctx against a's resolution so a publish made with
+// PublishWithContext or PublishAsyncWithContext can be cancelled cleanly: if
+// ctx is done first, the ack is pulled out of pubAckMap and its handler is
+// called with ctx.Err(); if the ack resolves first (acked, timed out, or the
+// connection was lost), this just returns.
+func (sc *conn) watchAckContext(ctx context.Context, a *ack) {
+	select {
+	case <-ctx.Done():
+		if removed := sc.removeAck(a.guid); removed != nil {
+			if removed.ah != nil {
+				removed.ah(removed.guid, ctx.Err())
+			}
+			if hook := sc.opts.TraceHooks.OnAck; hook != nil {
+				hook(removed.guid, ctx.Err())
+			}
+		}
+	case <-a.done:
+	}
+}
+
+// appendAckLocked adds a to the tail of the pub ack list. sc must be locked.
+func (sc *conn) appendAckLocked(a *ack) {
+	a.prev = sc.pubAckTail
+	a.next = nil
+	if sc.pubAckTail != nil {
+		sc.pubAckTail.next = a
+	} else {
+		sc.pubAckHead = a
+	}
+	sc.pubAckTail = a
+}
+
+// unlinkAckLocked removes a from the pub ack list, if it is in it.
+// sc must be locked.
+func (sc *conn) unlinkAckLocked(a *ack) {
+	if a.prev == nil && sc.pubAckHead != a {
+		// Not currently linked (e.g. ack'd before it was appended).
+		return
+	}
+	if a.prev != nil {
+		a.prev.next = a.next
+	} else {
+		sc.pubAckHead = a.next
+	}
+	if a.next != nil {
+		a.next.prev = a.prev
+	} else {
+		sc.pubAckTail = a.prev
+	}
+	a.prev, a.next = nil, nil
+}
+
+// signalAckTimeout wakes the ack expiration goroutine so it can re-arm its
+// sleep against the new head of the pub ack list.
+func (sc *conn) signalAckTimeout() {
+	select {
+	case sc.pubAckTimeoutCh <- struct{}{}:
+	default:
+	}
+}
+
+// ackTimeoutLoop is the single long-lived goroutine that expires pending
+// publish acks. It sleeps until the head of the list expires, pops every
+// ack that is now past its deadline, and calls each one's AckHandler with
+// ErrTimeout. Replacing a per-ack time.AfterFunc with this avoids runtime
+// timer-heap churn when thousands of acks are outstanding at once.
+func (sc *conn) ackTimeoutLoop() {
+	defer sc.pubAckTimerWG.Done()
+
+	quit := sc.pubAckTimeoutQuit
+
+	for {
+		sc.Lock()
+		head := sc.pubAckHead
+		sc.Unlock()
+
+		var wait time.Duration
+		if head == nil {
+			wait = time.Hour
+		} else if wait = time.Duration(head.expire - time.Now().UnixNano()); wait < 0 {
+			wait = 0
+		}
+
+		select {
+		case <-time.After(wait):
+			sc.expirePubAcks()
+		case <-sc.pubAckTimeoutCh:
+			// Head changed (append to an empty list, or head removed);
+			// loop around and recompute the wait time.
+		case <-quit:
+			return
+		}
+	}
+}
+
+// expirePubAcks pops every ack at the front of the list whose expiration
+// has passed, and reports ErrTimeout to each one's AckHandler.
+func (sc *conn) expirePubAcks() {
+	now := time.Now().UnixNano()
+
+	sc.Lock()
+	var expired []*ack
+	for sc.pubAckHead != nil && sc.pubAckHead.expire <= now {
+		a := sc.pubAckHead
+		sc.unlinkAckLocked(a)
+		delete(sc.pubAckMap, a.guid)
+		expired = append(expired, a)
+	}
+	pac := sc.pubAckChan
+	sc.Unlock()
+
+	for _, a := range expired {
+		if len(pac) > 0 {
+			<-pac
+		}
+		if a.done != nil {
+			close(a.done)
+		}
+		sc.log().Errorf("stan: publish ack for guid %q timed out", a.guid)
+		if a.ah != nil {
+			a.ah(a.guid, ErrTimeout)
+		}
+		if hook := sc.opts.TraceHooks.OnAck; hook != nil {
+			hook(a.guid, ErrTimeout)
+		}
+	}
+}
+
+// removeAck removes the ack from the pubAckMap and the pub ack list.
 func (sc *conn) removeAck(guid string) *ack {
 	sc.Lock()
 	a := sc.pubAckMap[guid]
+	if a == nil {
+		sc.Unlock()
+		return nil
+	}
 	delete(sc.pubAckMap, guid)
+	wasHead := sc.pubAckHead == a
+	sc.unlinkAckLocked(a)
 	pac := sc.pubAckChan
 	sc.Unlock()
 
-	// Cancel timer if needed.
-	if a != nil && a.t != nil {
-		a.t.Stop()
+	if wasHead {
+		sc.signalAckTimeout()
 	}
 
 	// Remove from channel to unblock PublishAsync
-	if a != nil && len(pac) > 0 {
+	if len(pac) > 0 {
 		<-pac
 	}
+	if a.done != nil {
+		close(a.done)
+	}
 	return a
 }
 
+// pingLoop periodically pings the server on pingRequests so the client can
+// detect a silent connection/server failure. Without this, Publish only
+// fails on AckTimeout and a Subscribe callback simply stops firing, with
+// no way for the application to tell the difference from "no new messages".
+func (sc *conn) pingLoop() {
+	defer sc.pingInfo.wg.Done()
+
+	sc.Lock()
+	interval := sc.opts.PingInterval
+	maxOut := sc.opts.PingMaxOut
+	quit := sc.pingInfo.quit
+	sc.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if sc.sendPing(maxOut) {
+				return
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+// sendPing sends a single ping to the server and returns true if, as a
+// result, the connection was declared lost.
+func (sc *conn) sendPing(maxOut int) bool {
+	sc.Lock()
+	if sc.nc == nil {
+		sc.Unlock()
+		return true
+	}
+	nc := sc.nc
+	pingRequests := sc.pingRequests
+	connID := sc.connID
+	sc.Unlock()
+
+	ping := &Ping{ConnID: connID}
+	b, _ := ping.Marshal()
+
+	_, err := nc.Request(pingRequests, b, defaultPingResponseWait)
+	if err == nil {
+		sc.pingInfo.Lock()
+		sc.pingInfo.out = 0
+		sc.pingInfo.Unlock()
+		return false
+	}
+
+	sc.pingInfo.Lock()
+	sc.pingInfo.out++
+	out := sc.pingInfo.out
+	sc.pingInfo.Unlock()
+
+	if out < maxOut {
+		return false
+	}
+
+	sc.connectionLost(ErrConnectionLost)
+	return true
+}
+
+// connectionLost tears down the connection after maxOut consecutive pings
+// go unanswered: every pending publish ack is released with err, and the
+// user's ConnectionLostHandler, if any, is invoked.
+func (sc *conn) connectionLost(err error) {
+	sc.Lock()
+	if sc.nc == nil {
+		sc.Unlock()
+		return
+	}
+	nc := sc.nc
+	sc.nc = nil
+	acks := sc.pubAckMap
+	sc.pubAckMap = make(map[string]*ack)
+	sc.pubAckHead, sc.pubAckTail = nil, nil
+	ackQuit := sc.pubAckTimeoutQuit
+	ackSub := sc.ackSubscription
+	cb := sc.opts.ConnectionLostCB
+	sc.Unlock()
+
+	if ackQuit != nil {
+		close(ackQuit)
+		sc.signalAckTimeout()
+		sc.pubAckTimerWG.Wait()
+	}
+	if ackSub != nil {
+		ackSub.Unsubscribe()
+	}
+	nc.Close()
+
+	for _, a := range acks {
+		if a.done != nil {
+			close(a.done)
+		}
+		if a.ah != nil {
+			a.ah(a.guid, err)
+		}
+		if hook := sc.opts.TraceHooks.OnAck; hook != nil {
+			hook(a.guid, err)
+		}
+	}
+
+	if cb != nil {
+		cb(sc, err)
+	}
+}
+
 // New style Inbox
 // FIXME(dlc) remove once ported back to nats client.
 func newInbox() string {
 	return fmt.Sprintf("_INBOX.%s", newGUID())
 }
 
+// newGUID returns a new globally unique identifier used for publish GUIDs
+// and private inbox subjects.
+func newGUID() string {
+	return nuid.Next()
+}
+
 // Helper function to produce time.Time from timestamp ns.
 func (m *Msg) Time() time.Time {
 	return time.Unix(0, m.Timestamp)
@@ -354,7 +808,8 @@ func (sc *conn) processMsg(raw *nats.Msg) {
 	msg := &Msg{}
 	err := msg.Unmarshal(raw.Data)
 	if err != nil {
-		panic("Error processing unmarshal for msg")
+		sc.log().Errorf("stan: error unmarshaling msg on subject %s: %v", raw.Subject, err)
+		return
 	}
 	// Lookup the subscription
 	sc.Lock()
@@ -364,6 +819,9 @@ func (sc *conn) processMsg(raw *nats.Msg) {
 
 	// Check if sub is no longer valid or connection has been closed.
 	if sub == nil || isClosed {
+		if sub == nil && !isClosed {
+			sc.log().Debugf("stan: no subscription found for delivery on %s", raw.Subject)
+		}
 		return
 	}
 
@@ -375,6 +833,7 @@ func (sc *conn) processMsg(raw *nats.Msg) {
 	ackSubject := sub.ackInbox
 	isManualAck := sub.opts.ManualAcks
 	subsc := sub.sc
+	errHandler := sub.errHandler
 	var nc *nats.Conn
 	if subsc != nil {
 		subsc.Lock()
@@ -383,10 +842,31 @@ func (sc *conn) processMsg(raw *nats.Msg) {
 	}
 	sub.RUnlock()
 
+	// Enforce the client-side pending message/byte limits before handing
+	// the message to the callback so a slow consumer can't grow memory
+	// without bound.
+	size := len(raw.Data)
+	if !sub.checkAndTrackPending(size) {
+		if errHandler != nil {
+			go errHandler(sub, ErrSlowConsumer)
+		}
+		return
+	}
+
+	if msg.Redelivered {
+		if hook := sc.opts.TraceHooks.OnRedeliver; hook != nil {
+			hook(msg.Subject, msg.Sequence)
+		}
+	}
+	if hook := sc.opts.TraceHooks.OnMsg; hook != nil {
+		hook(msg.Subject, msg.Sequence)
+	}
+
 	// Perform the callback
 	if cb != nil && subsc != nil {
 		cb(msg)
 	}
+	sub.donePending(size)
 
 	// Proces auto-ack
 	if !isManualAck && nc != nil {
@@ -0,0 +1,180 @@
+// Copyright 2019 Apcera Inc. All rights reserved.
+
+// Package stantest runs an embedded nats-streaming-server plus a connected
+// client against it, so tests can Publish/Subscribe/Ack over the real wire
+// protocol instead of a hand-rolled mock - the same role pstest plays for
+// Google's Pub/Sub client.
+package stantest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	natsd "github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/nats"
+	stan "github.com/nats-io/nats-streaming-server"
+	"github.com/nats-io/stan/pb"
+)
+
+// nextPort hands out one loopback port per NewServer call, starting well
+// above the well-known range, so concurrent tests in the same binary don't
+// collide on the embedded gnatsd's listener.
+var nextPort int32 = 23000
+
+// Server wraps an embedded *stan.ServerHandle with a client connection to
+// it. The ServerHandle is embedded so callers can reach any of its exported
+// methods (SetFlowControl, SetPendingLimits, Subscriptions, ...) directly
+// on a *Server; Publish/Messages/Ack below fill the gap between that
+// server-side surface and the client-side stan.Conn NewServer also holds.
+type Server struct {
+	*stan.ServerHandle
+
+	sc stan.Conn
+	nc *nats.Conn // raw conn, used only by Ack to publish a manual pb.Ack
+}
+
+// NewServer starts an embedded nats-streaming-server bound to a loopback
+// port private to this call, connects clientID to it, and returns the
+// wrapped Server plus a shutdown func that closes the client connection
+// and stops the server. Callers should always call the returned func, in a
+// defer, once done.
+func NewServer(clusterID, clientID string) (*Server, func(), error) {
+	port := int(atomic.AddInt32(&nextPort, 1))
+	natsOpts := &natsd.Options{
+		Host:   "127.0.0.1",
+		Port:   port,
+		NoLog:  true,
+		NoSigs: true,
+	}
+	srv := stan.RunServerWithOpts(clusterID, &stan.DefaultServerOptions, natsOpts)
+
+	natsURL := fmt.Sprintf("nats://127.0.0.1:%d", port)
+	sc, err := stan.Connect(clusterID, clientID, stan.NatsURL(natsURL))
+	if err != nil {
+		srv.Shutdown()
+		return nil, nil, err
+	}
+	nc, err := nats.Connect(natsURL)
+	if err != nil {
+		sc.Close()
+		srv.Shutdown()
+		return nil, nil, err
+	}
+
+	s := &Server{ServerHandle: srv, sc: sc, nc: nc}
+	shutdown := func() {
+		nc.Close()
+		sc.Close()
+		srv.Shutdown()
+	}
+	return s, shutdown, nil
+}
+
+// SetTime overrides the embedded server's clock (see stan.Clock and
+// stan.FixedClock), so StartAtTimeDelta subscriptions resolve against t
+// instead of the real wall clock.
+func (s *Server) SetTime(t time.Time) {
+	s.SetClock(stan.FixedClock(t))
+}
+
+// Publish publishes data on subject and returns the sequence the server
+// assigned it. Publish waits for the server's ack the same way sc.Publish
+// does, then reads the assignment back off ChannelSequence rather than
+// threading a sequence through the PubAck itself - the real protocol's
+// PubAck only carries a guid and an error, never a sequence, so this is the
+// only way to learn it without changing the wire format.
+func (s *Server) Publish(subject string, data []byte) (uint64, error) {
+	_, lastBefore := s.ChannelSequence(subject)
+	if err := s.sc.Publish(subject, data); err != nil {
+		return 0, err
+	}
+	_, last := s.ChannelSequence(subject)
+	if last == lastBefore {
+		return 0, fmt.Errorf("stantest: publish acked but channel sequence for %q did not advance", subject)
+	}
+	return last, nil
+}
+
+// Messages returns up to count messages stored for subject starting at
+// fromSeq, forwarding to the embedded server's ChannelMessages.
+func (s *Server) Messages(subject string, fromSeq uint64, count int) []*pb.MsgProto {
+	return s.ChannelMessages(subject, fromSeq, count)
+}
+
+// Conn returns the client connection NewServer made, for tests that need to
+// Subscribe/QueueSubscribe directly instead of going through Publish/Ack.
+func (s *Server) Conn() stan.Conn {
+	return s.sc
+}
+
+// Ack publishes a manual acknowledgement of seq to ackInbox on behalf of
+// clientID, for testing SetManualAckMode subscriptions and redelivery
+// without waiting on this package's own Msg.Ack plumbing. ackInbox and the
+// channel subject it acks on come from a SubscriptionInfo returned by
+// s.Subscriptions(clientID); see SubscriptionInfo.AckInbox.
+func (s *Server) Ack(clientID, ackInbox string, seq uint64) error {
+	var subject string
+	for _, info := range s.Subscriptions(clientID) {
+		if info.AckInbox == ackInbox {
+			subject = info.Subject
+			break
+		}
+	}
+	ack := &pb.Ack{Subject: subject, Sequence: seq}
+	b, err := ack.Marshal()
+	if err != nil {
+		return err
+	}
+	return s.nc.Publish(ackInbox, b)
+}
+
+// PullMode converts the queue member whose ack inbox is ackInbox (see
+// SubscriptionInfo.AckInbox) to pull mode, driving stan.PullModeRequest
+// directly against the embedded server's PullConvertSubject since this
+// package has no client-side wrapper for it yet.
+func (s *Server) PullMode(subject, ackInbox string) error {
+	req := &stan.PullModeRequest{Subject: subject, Inbox: ackInbox}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	reply, err := s.nc.Request(s.PullConvertSubject(), b, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	resp := &stan.PullModeResponse{}
+	if err := json.Unmarshal(reply.Data, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// Fetch requests up to batch not-yet-delivered messages for the pull-mode
+// queue member whose ack inbox is ackInbox, waiting up to maxWait for at
+// least one to become available (or returning immediately if noWait is
+// set); see stan.FetchRequest.
+func (s *Server) Fetch(subject, ackInbox string, batch int, maxWait time.Duration, noWait bool) ([]*pb.MsgProto, error) {
+	req := &stan.FetchRequest{Subject: subject, Inbox: ackInbox, Batch: batch, MaxWait: maxWait, NoWait: noWait}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := s.nc.Request(s.FetchSubject(), b, maxWait+2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	resp := &stan.FetchResponse{}
+	if err := json.Unmarshal(reply.Data, resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Msgs, nil
+}
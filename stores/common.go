@@ -3,13 +3,23 @@
 package stores
 
 import (
+	"errors"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/nats-io/stan-server/spb"
 	"github.com/nats-io/stan/pb"
 )
 
+// ErrSubMaxInFlight is returned by AddSeqPending when the subscription
+// already has MaxInFlight messages awaiting acknowledgement.
+var ErrSubMaxInFlight = errors.New("stores: too many messages in flight")
+
+// ackScanInterval is how often a genericSubStore looks for subscriptions
+// that have messages past their AckWait deadline.
+const ackScanInterval = 1 * time.Second
+
 // commonStore contains everything that is common to any type of store
 type commonStore struct {
 	sync.RWMutex
@@ -17,20 +27,48 @@ type commonStore struct {
 	closed bool
 }
 
+// reaperInterval is how often a genericStore's background reaper walks
+// its channels looking for messages to expire.
+const reaperInterval = 5 * time.Second
+
 // genericStore is the generic store implementation with a map of channels.
 type genericStore struct {
 	commonStore
-	name     string
-	channels map[string]*ChannelStore
+	name       string
+	channels   map[string]*ChannelStore
+	reaperQuit chan struct{}
+	reaperDone chan struct{}
 }
 
 // genericSubStore is the generic store implementation that manages subscriptions
 // for a given channel.
 type genericSubStore struct {
 	commonStore
-	subject   string // Can't be wildcard
-	subsCount int
-	nextSubID uint64
+	subject      string // Can't be wildcard
+	subsCount    int
+	nextSubID    uint64
+	subs         map[uint64]*subPending
+	onRedelivery func(subid, seqno uint64)
+	ackTimer     *time.Timer
+}
+
+// pendingMsg tracks delivery state for a single message sent to a
+// subscription but not yet acknowledged.
+type pendingMsg struct {
+	seqno        uint64
+	deliveryTime int64
+	redelivered  int
+}
+
+// subPending holds, in delivery order, the messages outstanding for a
+// single subscription, along with the limits used to enforce MaxInFlight
+// and AckWait.
+type subPending struct {
+	subid       uint64
+	maxInFlight int
+	ackWait     time.Duration
+	order       []uint64
+	msgs        map[uint64]*pendingMsg
 }
 
 // genericMsgStore is the generic store implementation that manages messages
@@ -43,6 +81,15 @@ type genericMsgStore struct {
 	msgs       map[uint64]*pb.MsgProto
 	totalCount int
 	totalBytes uint64
+	tsIndex    []tsEntry // sorted by timestamp, used by GetSequenceFromTimestamp/GetSequenceRange
+	hasPending func(seq uint64) bool
+	onTruncate func(newFirst uint64)
+}
+
+// tsEntry associates a sequence with the timestamp it was stored under.
+type tsEntry struct {
+	timestamp int64
+	seq       uint64
 }
 
 ////////////////////////////////////////////////////////////////////////////
@@ -59,6 +106,43 @@ func (gs *genericStore) init(name string, limits *ChannelLimits) {
 	}
 	// Do not use limits values to create the map.
 	gs.channels = make(map[string]*ChannelStore, 16)
+
+	gs.reaperQuit = make(chan struct{})
+	gs.reaperDone = make(chan struct{})
+	go gs.reapLoop()
+}
+
+// reapLoop periodically expires messages in every channel until the store
+// is closed.
+func (gs *genericStore) reapLoop() {
+	defer close(gs.reaperDone)
+
+	ticker := time.NewTicker(reaperInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			gs.reapOnce()
+		case <-gs.reaperQuit:
+			return
+		}
+	}
+}
+
+// reapOnce calls Expire on every channel's message store.
+func (gs *genericStore) reapOnce() {
+	gs.RLock()
+	channels := make([]*ChannelStore, 0, len(gs.channels))
+	for _, cs := range gs.channels {
+		channels = append(channels, cs)
+	}
+	gs.RUnlock()
+
+	now := time.Now().UnixNano()
+	for _, cs := range channels {
+		cs.Msgs.Expire(now)
+	}
 }
 
 // Name returns the type name of this store
@@ -130,18 +214,23 @@ func (gs *genericStore) canAddChannel() error {
 // Close closes all stores
 func (gs *genericStore) Close() error {
 	gs.Lock()
-	defer gs.Unlock()
-
 	if gs.closed {
+		gs.Unlock()
 		return nil
 	}
-
 	gs.closed = true
+	channels := gs.channels
+	gs.Unlock()
+
+	if gs.reaperQuit != nil {
+		close(gs.reaperQuit)
+		<-gs.reaperDone
+	}
 
 	var err error
 	var lerr error
 
-	for _, cs := range gs.channels {
+	for _, cs := range channels {
 		lerr = cs.Subs.Close()
 		if lerr != nil && err == nil {
 			err = lerr
@@ -222,21 +311,152 @@ func (gms *genericMsgStore) LastMsg() *pb.MsgProto {
 	return gms.msgs[gms.last]
 }
 
+// trackTimestamp records seq's timestamp in the sorted index used by
+// GetSequenceFromTimestamp/GetSequenceRange. Concrete Store() implementations
+// must call this after adding a message. gms must be locked.
+func (gms *genericMsgStore) trackTimestamp(seq uint64, timestamp int64) {
+	i := sort.Search(len(gms.tsIndex), func(i int) bool {
+		return gms.tsIndex[i].timestamp >= timestamp
+	})
+	gms.tsIndex = append(gms.tsIndex, tsEntry{})
+	copy(gms.tsIndex[i+1:], gms.tsIndex[i:])
+	gms.tsIndex[i] = tsEntry{timestamp: timestamp, seq: seq}
+}
+
+// untrackTimestamp removes seq from the timestamp index. Concrete
+// implementations must call this when a message is expired/removed.
+// gms must be locked.
+func (gms *genericMsgStore) untrackTimestamp(seq uint64) {
+	for i, e := range gms.tsIndex {
+		if e.seq == seq {
+			gms.tsIndex = append(gms.tsIndex[:i], gms.tsIndex[i+1:]...)
+			return
+		}
+	}
+}
+
 // GetSequenceFromTimestamp returns the sequence of the first message whose
-// timestamp is greater or equal to given timestamp.
+// timestamp is greater or equal to given timestamp, or gms.last+1 if there
+// is no such message. Unlike a plain index into the message map, this is
+// safe once sequences have become sparse due to expiration.
 func (gms *genericMsgStore) GetSequenceFromTimestamp(timestamp int64) uint64 {
 	gms.RLock()
 	defer gms.RUnlock()
 
-	index := sort.Search(len(gms.msgs), func(i int) bool {
-		m := gms.msgs[uint64(i)+gms.first]
-		if m.Timestamp >= timestamp {
-			return true
-		}
-		return false
+	index := sort.Search(len(gms.tsIndex), func(i int) bool {
+		return gms.tsIndex[i].timestamp >= timestamp
 	})
+	if index == len(gms.tsIndex) {
+		return gms.last + 1
+	}
+	return gms.tsIndex[index].seq
+}
+
+// GetSequenceRange returns the sequence of the first message with a
+// timestamp greater or equal to startTime, and the sequence of the last
+// message with a timestamp less or equal to endTime. If no message falls
+// in the range, first will be greater than last.
+func (gms *genericMsgStore) GetSequenceRange(startTime, endTime int64) (first, last uint64) {
+	gms.RLock()
+	defer gms.RUnlock()
+
+	startIdx := sort.Search(len(gms.tsIndex), func(i int) bool {
+		return gms.tsIndex[i].timestamp >= startTime
+	})
+	endIdx := sort.Search(len(gms.tsIndex), func(i int) bool {
+		return gms.tsIndex[i].timestamp > endTime
+	}) - 1
+
+	if startIdx == len(gms.tsIndex) || endIdx < 0 || startIdx > endIdx {
+		return 1, 0
+	}
+	return gms.tsIndex[startIdx].seq, gms.tsIndex[endIdx].seq
+}
+
+// Store adds m to the store under the next sequence and returns it.
+func (gms *genericMsgStore) Store(m *pb.MsgProto) (uint64, error) {
+	gms.Lock()
+	defer gms.Unlock()
+
+	gms.last++
+	m.Sequence = gms.last
+	gms.msgs[gms.last] = m
+	gms.totalCount++
+	gms.totalBytes += uint64(len(m.Data))
+	gms.trackTimestamp(gms.last, m.Timestamp)
+
+	return gms.last, nil
+}
+
+// SetHasPendingCallback registers the function Expire uses to find out
+// whether a message still has subscribers that haven't acknowledged it.
+// Age-based expiration leaves alone any message the callback reports as
+// pending; messages over a hard count/byte limit are evicted regardless.
+// Without a callback, age-based expiration evicts pending messages too.
+func (gms *genericMsgStore) SetHasPendingCallback(cb func(seq uint64) bool) {
+	gms.Lock()
+	gms.hasPending = cb
+	gms.Unlock()
+}
+
+// SetTruncateCallback registers the function invoked after Expire advances
+// FirstSequence, so that the server can tell subscribers whose requested
+// StartAtSequence fell below the new first sequence.
+func (gms *genericMsgStore) SetTruncateCallback(cb func(newFirst uint64)) {
+	gms.Lock()
+	gms.onTruncate = cb
+	gms.Unlock()
+}
+
+// Expire evicts messages from the front of the store that are over the
+// channel's MaxAge, or that make the channel exceed MaxMsgs/MaxBytes. A
+// MaxAge-driven eviction leaves alone any message that HasPendingCallback
+// reports as still having unacknowledged subscribers; a MaxMsgs/MaxBytes
+// overflow is relieved unconditionally, since otherwise the channel would
+// grow without bound.
+func (gms *genericMsgStore) Expire(now int64) (removedCount int, removedBytes uint64, err error) {
+	gms.Lock()
+
+	for gms.first <= gms.last {
+		m := gms.msgs[gms.first]
+		if m == nil {
+			gms.first++
+			continue
+		}
+
+		overCount := gms.limits.MaxMsgs > 0 && gms.totalCount > gms.limits.MaxMsgs
+		overBytes := gms.limits.MaxBytes > 0 && gms.totalBytes > gms.limits.MaxBytes
+		overAge := gms.limits.MaxAge > 0 && now-m.Timestamp >= gms.limits.MaxAge.Nanoseconds()
+
+		if !overCount && !overBytes && !overAge {
+			break
+		}
+
+		force := overCount || overBytes
+		if !force && gms.hasPending != nil && gms.hasPending(gms.first) {
+			break
+		}
+
+		sz := uint64(len(m.Data))
+		delete(gms.msgs, gms.first)
+		gms.untrackTimestamp(gms.first)
+		gms.totalCount--
+		gms.totalBytes -= sz
+		gms.first++
 
-	return uint64(index) + gms.first
+		removedCount++
+		removedBytes += sz
+	}
+
+	cb := gms.onTruncate
+	newFirst := gms.first
+	gms.Unlock()
+
+	if removedCount > 0 && cb != nil {
+		cb(newFirst)
+	}
+
+	return removedCount, removedBytes, nil
 }
 
 // Close closes this store.
@@ -252,6 +472,17 @@ func (gms *genericMsgStore) Close() error {
 func (gss *genericSubStore) init(channel string, limits ChannelLimits) {
 	gss.subject = channel
 	gss.limits = limits
+	gss.subs = make(map[uint64]*subPending)
+}
+
+// SetRedeliveryCallback registers the function invoked when a pending
+// message for a subscription managed by this store passes its AckWait
+// deadline without being acknowledged. The callback is responsible for
+// actually redelivering the message; this store only tracks the timing.
+func (gss *genericSubStore) SetRedeliveryCallback(cb func(subid, seqno uint64)) {
+	gss.Lock()
+	gss.onRedelivery = cb
+	gss.Unlock()
 }
 
 // CreateSub records a new subscription represented by SubState. On success,
@@ -276,6 +507,18 @@ func (gss *genericSubStore) createSub(sub *spb.SubState) error {
 
 	sub.ID = gss.nextSubID
 
+	maxInFlight := int(sub.MaxInFlight)
+	if maxInFlight <= 0 {
+		maxInFlight = 1
+	}
+	gss.subs[sub.ID] = &subPending{
+		subid:       sub.ID,
+		maxInFlight: maxInFlight,
+		ackWait:     time.Duration(sub.AckWaitInSecs) * time.Second,
+		msgs:        make(map[uint64]*pendingMsg),
+	}
+	gss.ensureAckTimerLocked()
+
 	return nil
 }
 
@@ -285,23 +528,137 @@ func (gss *genericSubStore) DeleteSub(subid uint64) {
 	defer gss.Unlock()
 
 	gss.subsCount--
+	delete(gss.subs, subid)
 }
 
-// AddSeqPending adds the given message seqno to the given subscription.
+// AddSeqPending adds the given message seqno to the given subscription,
+// recording the current time as its delivery time. It returns
+// ErrSubMaxInFlight if the subscription already has MaxInFlight messages
+// outstanding.
 func (gss *genericSubStore) AddSeqPending(subid, seqno uint64) error {
-	// no-op
+	gss.Lock()
+	defer gss.Unlock()
+
+	sp := gss.subs[subid]
+	if sp == nil {
+		return nil
+	}
+	if _, present := sp.msgs[seqno]; !present && len(sp.msgs) >= sp.maxInFlight {
+		return ErrSubMaxInFlight
+	}
+	if _, present := sp.msgs[seqno]; !present {
+		sp.order = append(sp.order, seqno)
+	}
+	sp.msgs[seqno] = &pendingMsg{seqno: seqno, deliveryTime: time.Now().UnixNano()}
+
 	return nil
 }
 
 // AckSeqPending records that the given message seqno has been acknowledged
 // by the given subscription.
 func (gss *genericSubStore) AckSeqPending(subid, seqno uint64) error {
-	// no-op
+	gss.Lock()
+	defer gss.Unlock()
+
+	sp := gss.subs[subid]
+	if sp == nil {
+		return nil
+	}
+	delete(sp.msgs, seqno)
+	for i, s := range sp.order {
+		if s == seqno {
+			sp.order = append(sp.order[:i], sp.order[i+1:]...)
+			break
+		}
+	}
+
 	return nil
 }
 
+// PendingSeqs returns, in delivery order, the sequences of the messages
+// currently outstanding (delivered but not acknowledged) for subid.
+func (gss *genericSubStore) PendingSeqs(subid uint64) []uint64 {
+	gss.RLock()
+	defer gss.RUnlock()
+
+	sp := gss.subs[subid]
+	if sp == nil {
+		return nil
+	}
+	seqs := make([]uint64, len(sp.order))
+	copy(seqs, sp.order)
+	return seqs
+}
+
+// GetPending returns the delivery time and redelivery count recorded for
+// seqno on subid, and whether it is still outstanding.
+func (gss *genericSubStore) GetPending(subid, seqno uint64) (deliveryTime int64, redeliveryCount int, ok bool) {
+	gss.RLock()
+	defer gss.RUnlock()
+
+	sp := gss.subs[subid]
+	if sp == nil {
+		return 0, 0, false
+	}
+	pm := sp.msgs[seqno]
+	if pm == nil {
+		return 0, 0, false
+	}
+	return pm.deliveryTime, pm.redelivered, true
+}
+
+// ensureAckTimerLocked starts the background scan loop the first time a
+// subscription is created. gss must be locked.
+func (gss *genericSubStore) ensureAckTimerLocked() {
+	if gss.ackTimer != nil {
+		return
+	}
+	gss.ackTimer = time.AfterFunc(ackScanInterval, gss.scanForExpired)
+}
+
+// scanForExpired looks at every subscription's pending messages and
+// invokes the redelivery callback for any that have passed their AckWait
+// deadline, then reschedules itself.
+func (gss *genericSubStore) scanForExpired() {
+	gss.Lock()
+	if gss.closed {
+		gss.Unlock()
+		return
+	}
+	now := time.Now().UnixNano()
+	cb := gss.onRedelivery
+	var expired []struct{ subid, seqno uint64 }
+	for subid, sp := range gss.subs {
+		for _, seqno := range sp.order {
+			pm := sp.msgs[seqno]
+			if pm == nil {
+				continue
+			}
+			if now-pm.deliveryTime >= sp.ackWait.Nanoseconds() {
+				pm.deliveryTime = now
+				pm.redelivered++
+				expired = append(expired, struct{ subid, seqno uint64 }{subid, seqno})
+			}
+		}
+	}
+	gss.ackTimer = time.AfterFunc(ackScanInterval, gss.scanForExpired)
+	gss.Unlock()
+
+	if cb != nil {
+		for _, e := range expired {
+			cb(e.subid, e.seqno)
+		}
+	}
+}
+
 // Close closes this store
 func (gss *genericSubStore) Close() error {
-	// no-op
+	gss.Lock()
+	defer gss.Unlock()
+
+	gss.closed = true
+	if gss.ackTimer != nil {
+		gss.ackTimer.Stop()
+	}
 	return nil
 }
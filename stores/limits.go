@@ -0,0 +1,115 @@
+// Copyright 2016 Apcera Inc. All rights reserved.
+
+package stores
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nats-io/stan-server/spb"
+	"github.com/nats-io/stan/pb"
+)
+
+// AllChannels can be used in calls to MsgsState to get the cumulative
+// state of all channels.
+const AllChannels = "*"
+
+// Defaults for ChannelLimits.
+const (
+	DefaultMaxChannels = 100
+	DefaultMaxSubs     = 1000
+	DefaultMaxMsgs     = 1000000
+	DefaultMaxBytes    = 1024 * 1024 * 1024
+	DefaultMaxAge      = time.Duration(0) // no age limit
+)
+
+var (
+	// ErrTooManyChannels is returned when the store's MaxChannels limit is reached.
+	ErrTooManyChannels = errors.New("stores: too many channels")
+	// ErrTooManySubs is returned when a channel's MaxSubs limit is reached.
+	ErrTooManySubs = errors.New("stores: too many subscriptions per channel")
+)
+
+// DefaultChannelLimits holds the limits used when a store is created
+// without explicit ChannelLimits.
+var DefaultChannelLimits = ChannelLimits{
+	MaxChannels: DefaultMaxChannels,
+	MaxSubs:     DefaultMaxSubs,
+	MaxMsgs:     DefaultMaxMsgs,
+	MaxBytes:    DefaultMaxBytes,
+	MaxAge:      DefaultMaxAge,
+}
+
+// ChannelLimits defines how many channels a store may hold, and how many
+// subscriptions, messages, bytes and how much message age a single
+// channel may hold before the store starts rejecting or expiring data.
+// A zero value for MaxAge means messages are never expired by age.
+type ChannelLimits struct {
+	MaxChannels int
+	MaxSubs     int
+	MaxMsgs     int
+	MaxBytes    uint64
+	MaxAge      time.Duration
+}
+
+// ChannelStore groups the message and subscription stores for a channel.
+type ChannelStore struct {
+	Subs SubStore
+	Msgs MsgStore
+}
+
+// SubStore is the interface implemented by any subscription store backend.
+type SubStore interface {
+	// CreateSub records a new subscription and assigns it an ID.
+	CreateSub(sub *spb.SubState) error
+	// DeleteSub invalidates the given subscription.
+	DeleteSub(subid uint64)
+	// AddSeqPending records seqno as delivered, but not yet acknowledged,
+	// for subid.
+	AddSeqPending(subid, seqno uint64) error
+	// AckSeqPending records seqno as acknowledged by subid.
+	AckSeqPending(subid, seqno uint64) error
+	// PendingSeqs returns, in delivery order, the sequences outstanding for subid.
+	PendingSeqs(subid uint64) []uint64
+	// GetPending returns the delivery time and redelivery count for seqno on subid.
+	GetPending(subid, seqno uint64) (deliveryTime int64, redeliveryCount int, ok bool)
+	// SetRedeliveryCallback registers the function invoked when a pending
+	// message passes its AckWait deadline.
+	SetRedeliveryCallback(cb func(subid, seqno uint64))
+	// Close closes the store.
+	Close() error
+}
+
+// MsgStore is the interface implemented by any message store backend.
+type MsgStore interface {
+	// Store stores a message and returns its assigned sequence.
+	Store(m *pb.MsgProto) (seq uint64, err error)
+	// State returns the number of messages and total bytes stored.
+	State() (numMessages int, byteSize uint64, err error)
+	// FirstSequence returns the sequence of the first message stored.
+	FirstSequence() uint64
+	// LastSequence returns the sequence of the last message stored.
+	LastSequence() uint64
+	// FirstAndLastSequence returns the first and last sequences stored.
+	FirstAndLastSequence() (uint64, uint64)
+	// Lookup returns the message stored under seq, or nil.
+	Lookup(seq uint64) *pb.MsgProto
+	// FirstMsg returns the first message stored, or nil.
+	FirstMsg() *pb.MsgProto
+	// LastMsg returns the last message stored, or nil.
+	LastMsg() *pb.MsgProto
+	// GetSequenceFromTimestamp returns the sequence of the first message
+	// with a timestamp greater or equal to the given timestamp.
+	GetSequenceFromTimestamp(timestamp int64) uint64
+	// GetSequenceRange returns the first and last sequence in [startTime, endTime].
+	GetSequenceRange(startTime, endTime int64) (first, last uint64)
+	// Expire evicts messages that exceed the channel's age, count or byte
+	// limits and returns how many messages/bytes were removed.
+	Expire(now int64) (removedCount int, removedBytes uint64, err error)
+	// SetTruncateCallback registers the function invoked when expiration
+	// advances FirstSequence past a point a caller may still want to
+	// start a subscription from.
+	SetTruncateCallback(cb func(newFirst uint64))
+	// Close closes the store.
+	Close() error
+}
@@ -4,7 +4,9 @@
 package stan
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 
@@ -14,6 +16,13 @@ import (
 const (
 	DefaultAckWait     = 30 * time.Second
 	DefaultMaxInflight = 1024
+
+	// DefaultMaxPendingMsgs is the default maximum number of messages a
+	// subscription will buffer client-side before dropping new ones.
+	DefaultMaxPendingMsgs = 65536
+	// DefaultMaxPendingBytes is the default maximum number of bytes a
+	// subscription will buffer client-side before dropping new messages.
+	DefaultMaxPendingBytes = 64 * 1024 * 1024
 )
 
 // Client defined Msg, which includes proto, then back link to subscription.
@@ -28,6 +37,49 @@ type Msg struct {
 // will be rate matched and follow at-least delivery semantics.
 type Subscription interface {
 	Unsubscribe() error
+
+	// Close suspends the subscription without removing server-side state.
+	// For non-durable subscriptions this behaves like Unsubscribe. For a
+	// durable subscription, the client-side inbox is detached but the
+	// durable's state (including pending acks) is kept on the server, so
+	// that reconnecting later with the same DurableName resumes from the
+	// last acknowledged sequence. Unsubscribe should be used instead when
+	// the durable interest should be removed permanently.
+	Close() error
+
+	// SetPendingLimits sets the client-side pending message and byte limits
+	// for this subscription. These limits protect a slow consumer from
+	// being overrun by a fast publisher; once exceeded, further messages
+	// are dropped and counted (see Dropped). A value <= 0 disables that
+	// particular limit.
+	SetPendingLimits(msgLimit, bytesLimit int) error
+
+	// PendingLimits returns the current pending message and byte limits
+	// for this subscription.
+	PendingLimits() (int, int, error)
+
+	// Pending returns the number of queued messages and bytes currently
+	// buffered client-side, waiting to be processed by the callback.
+	Pending() (int, int, error)
+
+	// MaxPending returns the high-water mark for queued messages and
+	// bytes observed for this subscription since creation or the last
+	// call to ClearMaxPending.
+	MaxPending() (int, int, error)
+
+	// ClearMaxPending resets the high-water marks returned by MaxPending.
+	ClearMaxPending() error
+
+	// Delivered returns the number of messages delivered to the callback.
+	Delivered() (int64, error)
+
+	// Dropped returns the number of messages dropped because of exceeded
+	// pending limits.
+	Dropped() (int, error)
+
+	// IsValid returns false if the subscription has been unsubscribed or
+	// its connection closed.
+	IsValid() bool
 }
 
 // A subscription represents a subscription to a stan cluster.
@@ -41,6 +93,17 @@ type subscription struct {
 	inboxSub *nats.Subscription
 	opts     SubscriptionOptions
 	cb       MsgHandler
+
+	// Client-side pending limits and accounting.
+	pendingMsgLimit   int
+	pendingBytesLimit int
+	pendingMsgs       int
+	pendingBytes      int
+	maxPendingMsgs    int
+	maxPendingBytes   int
+	delivered         int64
+	dropped           int
+	errHandler        func(Subscription, error)
 }
 
 // SubscriptionOption is a function on the options for a subscription.
@@ -64,8 +127,18 @@ type SubscriptionOptions struct {
 	StartSequence uint64
 	// Optional start time.
 	StartTime time.Time
+	// Optional start time, expressed as a duration before now.
+	StartTimeDelta time.Duration
 	// Option to do Manual Acks
 	ManualAcks bool
+	// Exclusive marks a queue subscription single-active (see
+	// ExclusiveQueue): only one member of the group - the oldest
+	// surviving one - ever receives a message. Meaningless on a
+	// non-queue Subscribe.
+	Exclusive bool
+	// errHandler, if set, is invoked when this subscription drops a
+	// message due to exceeded pending limits.
+	errHandler func(Subscription, error)
 }
 
 var DefaultSubscriptionOptions = SubscriptionOptions{
@@ -117,6 +190,17 @@ func StartAtTime(start time.Time) SubscriptionOption {
 	}
 }
 
+// StartAtTimeDelta sets the desired start position as a time relative to
+// now, e.g. stan.StartAtTimeDelta(30*time.Minute) to get everything from
+// the last half hour.
+func StartAtTimeDelta(ago time.Duration) SubscriptionOption {
+	return func(o *SubscriptionOptions) error {
+		o.StartAt = StartPosition_TimeDeltaStart
+		o.StartTimeDelta = ago
+		return nil
+	}
+}
+
 // StartWithLastReceived is a helper function to set start position to last received.
 func StartWithLastReceived() SubscriptionOption {
 	return func(o *SubscriptionOptions) error {
@@ -149,6 +233,28 @@ func DurableName(name string) SubscriptionOption {
 	}
 }
 
+// ExclusiveQueue marks a QueueSubscribe single-active: every member still
+// registers as normal, but only the oldest surviving member ever receives a
+// message, with the next one promoted (and handed its predecessor's pending,
+// unacked messages) if it disconnects or unsubscribes. Has no effect on a
+// plain Subscribe.
+func ExclusiveQueue() SubscriptionOption {
+	return func(o *SubscriptionOptions) error {
+		o.Exclusive = true
+		return nil
+	}
+}
+
+// SetErrorHandler registers a callback invoked asynchronously whenever this
+// subscription drops a message because it exceeded its pending limits (see
+// Subscription.SetPendingLimits).
+func SetErrorHandler(cb func(Subscription, error)) SubscriptionOption {
+	return func(o *SubscriptionOptions) error {
+		o.errHandler = cb
+		return nil
+	}
+}
+
 // Subscribe will perform a subscription with the given options to the STAN cluster.
 func (sc *conn) Subscribe(subject string, cb MsgHandler, options ...SubscriptionOption) (Subscription, error) {
 	return sc.subscribe(subject, "", cb, options...)
@@ -161,12 +267,22 @@ func (sc *conn) QueueSubscribe(subject, qgroup string, cb MsgHandler, options ..
 
 // subscribe will perform a subscription with the given options to the STAN cluster.
 func (sc *conn) subscribe(subject, qgroup string, cb MsgHandler, options ...SubscriptionOption) (Subscription, error) {
-	sub := &subscription{subject: subject, qgroup: qgroup, inbox: newInbox(), cb: cb, sc: sc, opts: DefaultSubscriptionOptions}
+	sub := &subscription{
+		subject:           subject,
+		qgroup:            qgroup,
+		inbox:             newInbox(),
+		cb:                cb,
+		sc:                sc,
+		opts:              DefaultSubscriptionOptions,
+		pendingMsgLimit:   DefaultMaxPendingMsgs,
+		pendingBytesLimit: DefaultMaxPendingBytes,
+	}
 	for _, opt := range options {
 		if err := opt(&sub.opts); err != nil {
 			return nil, err
 		}
 	}
+	sub.errHandler = sub.opts.errHandler
 	sc.Lock()
 	if sc.nc == nil {
 		sc.Unlock()
@@ -206,6 +322,8 @@ func (sc *conn) subscribe(subject, qgroup string, cb MsgHandler, options ...Subs
 	switch sr.StartPosition {
 	case StartPosition_TimeStart:
 		sr.StartTime = sub.opts.StartTime.UnixNano()
+	case StartPosition_TimeDeltaStart:
+		sr.StartTimeDelta = int64(sub.opts.StartTimeDelta)
 	case StartPosition_SequenceStart:
 		sr.StartSequence = sub.opts.StartSequence
 	}
@@ -227,11 +345,112 @@ func (sc *conn) subscribe(subject, qgroup string, cb MsgHandler, options ...Subs
 	}
 	sub.ackInbox = r.AckInbox
 
+	if qgroup != "" && sub.opts.Exclusive {
+		if err := sc.markQueueExclusive(subject, qgroup); err != nil {
+			// FIXME(dlc) unwind subscription from above.
+			return nil, err
+		}
+	}
+
 	return sub, nil
 }
 
-// Unsubscribe removes interest in the subscription
+// markQueueExclusive sends an ExclusiveQueueRequest for subject/qgroup,
+// deriving the server's exclusiveQueueRequests subject the same
+// deterministic way the server itself does (see DefaultExclusiveQueuePrefix)
+// rather than needing it handed back over the wire the way subRequests and
+// the other ConnectResponse-discovered subjects are.
+func (sc *conn) markQueueExclusive(subject, qgroup string) error {
+	exclusiveQueueSubject := fmt.Sprintf("%s.%s", DefaultExclusiveQueuePrefix, sc.clusterID)
+	req := &ExclusiveQueueRequest{Subject: subject, QGroup: qgroup}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	reply, err := sc.nc.Request(exclusiveQueueSubject, b, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	resp := &ExclusiveQueueResponse{}
+	if err := json.Unmarshal(reply.Data, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// BindQueueGroup attaches to a queue group that already has at least one
+// member on subject, rather than creating one: unlike QueueSubscribe, which
+// creates qgroup as a side effect of the first member to join, this first
+// confirms the group already exists (see checkQueueGroupExists) and fails
+// with the server's ErrInvalidSub if it doesn't, rather than silently
+// starting a new group under that name. The existence check and the
+// subscribe that follows it are two separate server requests, but the
+// server closes the gap between them itself (subState.Store re-checks the
+// group under the same lock that would create it, against a marker this
+// check leaves behind - see CheckAndMarkPendingBind), so a group that loses
+// its last member in between still can't be silently recreated out from
+// under this call. Useful for an operator-style consumer that should only
+// ever join a group some other process is responsible for creating.
+//
+// This is the non-durable case of what's sometimes called binding to a
+// durable queue group elsewhere: this server forbids a queue subscriber
+// from being durable at all (see ErrDurableQueue), so there is no durable
+// queue group variant to bind to here.
+func (sc *conn) BindQueueGroup(subject, qgroup string, cb MsgHandler, options ...SubscriptionOption) (Subscription, error) {
+	if err := sc.checkQueueGroupExists(subject, qgroup); err != nil {
+		return nil, err
+	}
+	return sc.subscribe(subject, qgroup, cb, options...)
+}
+
+// checkQueueGroupExists asks the server whether qgroup already has a member
+// on subject, deriving the server's queueGroupRequests subject the same
+// deterministic way markQueueExclusive derives exclusiveQueueRequests. The
+// server marks this client's upcoming subscribe as a pending bind in the
+// same locked check (see CheckAndMarkPendingBind), so the subsequent
+// subscribe call is rejected instead of silently creating a new group if
+// the group drains in between.
+func (sc *conn) checkQueueGroupExists(subject, qgroup string) error {
+	queueGroupSubject := fmt.Sprintf("%s.%s", DefaultQueueGroupPrefix, sc.clusterID)
+	req := &QueueGroupRequest{Subject: subject, QGroup: qgroup, ClientID: sc.clientID}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	reply, err := sc.nc.Request(queueGroupSubject, b, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	resp := &QueueGroupResponse{}
+	if err := json.Unmarshal(reply.Data, resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// Unsubscribe removes interest in the subscription. For a durable
+// subscription, this permanently removes the durable's state on the server;
+// use Close to suspend a durable without losing its position.
 func (sub *subscription) Unsubscribe() error {
+	return sub.closeOrUnsubscribe(false)
+}
+
+// Close suspends the subscription. See the Subscription interface for the
+// distinction between Close and Unsubscribe.
+func (sub *subscription) Close() error {
+	return sub.closeOrUnsubscribe(true)
+}
+
+// closeOrUnsubscribe detaches the client-side inbox and notifies the server,
+// either to suspend (doClose) or to permanently remove (!doClose) the
+// subscription's server-side state.
+func (sub *subscription) closeOrUnsubscribe(doClose bool) error {
 	if sub == nil {
 		return ErrBadSubscription
 	}
@@ -260,11 +479,12 @@ func (sub *subscription) Unsubscribe() error {
 
 	delete(sc.subMap, inbox)
 	reqSubject := sc.unsubRequests
+	if doClose {
+		reqSubject = sc.subCloseRequests
+	}
 	sc.Unlock()
 
-	// Send Unsubscribe to server.
-
-	// FIXME(dlc) - Add in durable?
+	// Send Unsubscribe/Close request to server.
 	usr := &UnsubscribeRequest{
 		ClientID: sc.clientID,
 		Subject:  sub.subject,
@@ -287,6 +507,146 @@ func (sub *subscription) Unsubscribe() error {
 	return nil
 }
 
+// SetPendingLimits sets the client-side pending message and byte limits.
+func (sub *subscription) SetPendingLimits(msgLimit, bytesLimit int) error {
+	if sub == nil {
+		return ErrBadSubscription
+	}
+	sub.Lock()
+	defer sub.Unlock()
+	if sub.sc == nil {
+		return ErrBadSubscription
+	}
+	sub.pendingMsgLimit = msgLimit
+	sub.pendingBytesLimit = bytesLimit
+	return nil
+}
+
+// PendingLimits returns the currently configured pending message and byte limits.
+func (sub *subscription) PendingLimits() (int, int, error) {
+	if sub == nil {
+		return 0, 0, ErrBadSubscription
+	}
+	sub.RLock()
+	defer sub.RUnlock()
+	if sub.sc == nil {
+		return 0, 0, ErrBadSubscription
+	}
+	return sub.pendingMsgLimit, sub.pendingBytesLimit, nil
+}
+
+// Pending returns the number of queued messages and bytes.
+func (sub *subscription) Pending() (int, int, error) {
+	if sub == nil {
+		return 0, 0, ErrBadSubscription
+	}
+	sub.RLock()
+	defer sub.RUnlock()
+	if sub.sc == nil {
+		return 0, 0, ErrBadSubscription
+	}
+	return sub.pendingMsgs, sub.pendingBytes, nil
+}
+
+// MaxPending returns the high-water mark for pending messages and bytes.
+func (sub *subscription) MaxPending() (int, int, error) {
+	if sub == nil {
+		return 0, 0, ErrBadSubscription
+	}
+	sub.RLock()
+	defer sub.RUnlock()
+	if sub.sc == nil {
+		return 0, 0, ErrBadSubscription
+	}
+	return sub.maxPendingMsgs, sub.maxPendingBytes, nil
+}
+
+// ClearMaxPending resets the high-water marks for pending messages and bytes.
+func (sub *subscription) ClearMaxPending() error {
+	if sub == nil {
+		return ErrBadSubscription
+	}
+	sub.Lock()
+	defer sub.Unlock()
+	if sub.sc == nil {
+		return ErrBadSubscription
+	}
+	sub.maxPendingMsgs = 0
+	sub.maxPendingBytes = 0
+	return nil
+}
+
+// Delivered returns the number of messages delivered to the callback.
+func (sub *subscription) Delivered() (int64, error) {
+	if sub == nil {
+		return 0, ErrBadSubscription
+	}
+	sub.RLock()
+	defer sub.RUnlock()
+	if sub.sc == nil {
+		return 0, ErrBadSubscription
+	}
+	return sub.delivered, nil
+}
+
+// Dropped returns the number of messages dropped due to exceeded pending limits.
+func (sub *subscription) Dropped() (int, error) {
+	if sub == nil {
+		return 0, ErrBadSubscription
+	}
+	sub.RLock()
+	defer sub.RUnlock()
+	if sub.sc == nil {
+		return 0, ErrBadSubscription
+	}
+	return sub.dropped, nil
+}
+
+// IsValid returns false if the subscription has been unsubscribed or its
+// connection closed.
+func (sub *subscription) IsValid() bool {
+	if sub == nil {
+		return false
+	}
+	sub.RLock()
+	defer sub.RUnlock()
+	return sub.sc != nil
+}
+
+// checkAndTrackPending checks the pending limits before queuing a message of
+// the given size for delivery, updating the accounting and high-water marks.
+// It returns false if the message should be dropped.
+func (sub *subscription) checkAndTrackPending(size int) bool {
+	sub.Lock()
+	defer sub.Unlock()
+
+	if (sub.pendingMsgLimit > 0 && sub.pendingMsgs+1 > sub.pendingMsgLimit) ||
+		(sub.pendingBytesLimit > 0 && sub.pendingBytes+size > sub.pendingBytesLimit) {
+		sub.dropped++
+		return false
+	}
+
+	sub.pendingMsgs++
+	sub.pendingBytes += size
+	if sub.pendingMsgs > sub.maxPendingMsgs {
+		sub.maxPendingMsgs = sub.pendingMsgs
+	}
+	if sub.pendingBytes > sub.maxPendingBytes {
+		sub.maxPendingBytes = sub.pendingBytes
+	}
+	return true
+}
+
+// donePending records that a queued message has been handed to the callback
+// and is no longer counted against the pending limits.
+func (sub *subscription) donePending(size int) {
+	sub.Lock()
+	sub.pendingMsgs--
+	sub.pendingBytes -= size
+	sub.delivered++
+	sub.Unlock()
+}
+
 // Manually Ack a Message.
 func (msg *Msg) Ack() error {
 	if msg == nil {